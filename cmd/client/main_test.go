@@ -0,0 +1,173 @@
+package main
+
+import (
+	"context"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/bootdotdev/learn-pub-sub-starter/internal/gamelogic"
+	"github.com/bootdotdev/learn-pub-sub-starter/internal/pubsub"
+	"github.com/bootdotdev/learn-pub-sub-starter/internal/routing"
+)
+
+// player runs one client's move and war handlers against b, with an outbox
+// relaying what they record.
+func player(t *testing.T, ctx context.Context, b *pubsub.MemoryBroker, name string) (*gamelogic.GameState, *pubsub.Outbox) {
+	t.Helper()
+	gs := gamelogic.NewGameState(name)
+	outbox, err := pubsub.OpenOutbox(filepath.Join(t.TempDir(), name+".jsonl"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { outbox.Close() })
+	ch, err := b.Channel()
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { ch.Close() })
+	go outbox.Relay(ctx, ch)
+
+	moveSub, err := pubsub.SubscribeContext(ctx, b,
+		routing.ExchangePerilTopic,
+		routing.ArmyMovesPrefix+"."+name,
+		routing.ArmyMovesPrefix+".*",
+		pubsub.TransientQueue,
+		handlerMove(outbox, gs),
+		pubsub.WithValidation(),
+	)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { moveSub.Close() })
+	warSub, err := pubsub.SubscribeContext(ctx, b,
+		routing.ExchangePerilTopic,
+		routing.WarRecognitionsPrefix+"."+name,
+		routing.WarRecognitionsPrefix+"."+name,
+		pubsub.DurableQueue,
+		handlerWar(outbox, gs),
+		pubsub.WithRetry(pubsub.ExponentialRetry(5*time.Millisecond, 5)),
+		pubsub.WithValidation(),
+	)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { warSub.Close() })
+	return gs, outbox
+}
+
+// A move into another player's territory starts a war, and the war's result
+// is logged.
+func TestMoveStartsWarAndLogsResult(t *testing.T) {
+	b := pubsub.NewMemoryBroker()
+	err := pubsub.DeclareTopology(b, routing.PerilTopology())
+	if err != nil {
+		t.Fatal(err)
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	logs := make(chan routing.GameLog, 10)
+	logSub, err := pubsub.Subscribe(ctx, b,
+		routing.ExchangePerilTopic,
+		routing.GameLogSlug,
+		routing.GameLogSlug+".*",
+		pubsub.DurableQueue,
+		func(gl routing.GameLog) pubsub.SimpleAckType {
+			logs <- gl
+			return pubsub.Ack
+		},
+		pubsub.WithValidation(),
+	)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer logSub.Close()
+
+	alice, aliceOutbox := player(t, ctx, b, "alice")
+	bob, _ := player(t, ctx, b, "bob")
+	for _, cmd := range []struct {
+		gs    *gamelogic.GameState
+		words string
+	}{
+		{alice, "spawn americas artillery"},
+		{alice, "spawn americas artillery"},
+		{bob, "spawn europe infantry"},
+	} {
+		err := cmd.gs.CommandSpawn(strings.Fields(cmd.words))
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	err = commandMove(ctx, aliceOutbox, alice, strings.Fields("move europe 1 2"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if u, _ := alice.GetUnit(1); u.Location != "europe" {
+		t.Errorf("alice's unit is in %s after moving, want europe", u.Location)
+	}
+
+	// Bob sees the move and declares war, so bob resolves it, loses to
+	// alice's artillery and logs the result.
+	select {
+	case gl := <-logs:
+		if gl.Username != "bob" || gl.Message != "alice won a war against bob" {
+			t.Errorf("got log %q from %s, want bob logging alice's win", gl.Message, gl.Username)
+		}
+	case <-time.After(2 * time.Second):
+		t.Fatal("no game log after the war")
+	}
+	if units := bob.GetPlayerSnap().Units; len(units) != 0 {
+		t.Errorf("bob still has %d units in europe", len(units))
+	}
+}
+
+// A lost war only kills the player's units once its game log is recorded,
+// so a war that couldn't be logged is fought again when redelivered.
+func TestWarAppliedWithGameLog(t *testing.T) {
+	alice := gamelogic.NewGameState("alice")
+	bob := gamelogic.NewGameState("bob")
+	for _, cmd := range []struct {
+		gs    *gamelogic.GameState
+		words string
+	}{
+		{alice, "spawn europe artillery"},
+		{bob, "spawn europe infantry"},
+	} {
+		err := cmd.gs.CommandSpawn(strings.Fields(cmd.words))
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	war := gamelogic.RecognitionOfWar{Attacker: bob.GetPlayerSnap(), Defender: alice.GetPlayerSnap()}
+	path := filepath.Join(t.TempDir(), "bob.jsonl")
+
+	broken, err := pubsub.OpenOutbox(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	broken.Close()
+	if ack := handlerWar(broken, bob)(context.Background(), war); ack != pubsub.NackRequeue {
+		t.Fatalf("got %v with a broken outbox, want %v", ack, pubsub.NackRequeue)
+	}
+	if n := len(bob.GetPlayerSnap().Units); n != 1 {
+		t.Fatalf("bob has %d units after an unlogged war, want 1", n)
+	}
+
+	outbox, err := pubsub.OpenOutbox(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer outbox.Close()
+	if ack := handlerWar(outbox, bob)(context.Background(), war); ack != pubsub.Ack {
+		t.Fatalf("got %v on redelivery, want %v", ack, pubsub.Ack)
+	}
+	if n := len(bob.GetPlayerSnap().Units); n != 0 {
+		t.Errorf("bob has %d units after losing the war, want 0", n)
+	}
+	if n := outbox.Pending(); n != 1 {
+		t.Errorf("outbox has %d messages, want the game log", n)
+	}
+}
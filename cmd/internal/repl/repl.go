@@ -0,0 +1,18 @@
+// Package repl holds helpers shared by the Peril command-line REPLs.
+package repl
+
+import (
+	"context"
+	"fmt"
+
+	"github.com/bootdotdev/learn-pub-sub-starter/internal/pubsub"
+)
+
+// Prompt is subscription middleware that reprints the REPL prompt after a
+// handler has written to the terminal.
+func Prompt(next pubsub.HandlerFunc) pubsub.HandlerFunc {
+	return func(ctx context.Context, msg pubsub.Message) pubsub.SimpleAckType {
+		defer fmt.Print("> ")
+		return next(ctx, msg)
+	}
+}
@@ -0,0 +1,72 @@
+package main
+
+import (
+	"context"
+	"os"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/bootdotdev/learn-pub-sub-starter/internal/pubsub"
+	"github.com/bootdotdev/learn-pub-sub-starter/internal/routing"
+)
+
+// Game logs published by a client end up in the server's log file.
+func TestHandlerLogWritesGameLogs(t *testing.T) {
+	wd, err := os.Getwd()
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = os.Chdir(t.TempDir())
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { os.Chdir(wd) })
+
+	b := pubsub.NewMemoryBroker()
+	err = pubsub.DeclareTopology(b, routing.PerilTopology())
+	if err != nil {
+		t.Fatal(err)
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	ch, err := b.Channel()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ch.Close()
+	sub, err := pubsub.Subscribe(ctx, b,
+		routing.ExchangePerilTopic,
+		routing.GameLogSlug,
+		routing.GameLogSlug+".*",
+		pubsub.DurableQueue,
+		handlerLog(ch),
+		pubsub.WithValidation(),
+	)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer sub.Close()
+
+	err = pubsub.PublishGob(ch, routing.ExchangePerilTopic, routing.GameLogSlug+".bob", routing.GameLog{
+		CurrentTime: time.Now(),
+		Message:     "alice won a war against bob",
+		Username:    "bob",
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	want := "bob: alice won a war against bob\n"
+	deadline := time.Now().Add(3 * time.Second)
+	for {
+		got, _ := os.ReadFile("game.log")
+		if strings.HasSuffix(string(got), want) {
+			return
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("game.log is %q, want a line ending %q", got, want)
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
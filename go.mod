@@ -3,5 +3,10 @@ module github.com/bootdotdev/learn-pub-sub-starter
 go 1.22.1
 
 require (
+	github.com/golang/snappy v0.0.4
 	github.com/rabbitmq/amqp091-go v1.10.0
+	github.com/vmihailenco/msgpack/v5 v5.4.1
+	gopkg.in/yaml.v3 v3.0.1
 )
+
+require github.com/vmihailenco/tagparser/v2 v2.0.0 // indirect
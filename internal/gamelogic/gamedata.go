@@ -1,5 +1,10 @@
 package gamelogic
 
+import (
+	"errors"
+	"fmt"
+)
+
 type Player struct {
 	Username string
 	Units    map[int]Unit
@@ -25,11 +30,90 @@ type ArmyMove struct {
 	ToLocation Location
 }
 
+// Sender is the player who made the move.
+func (m ArmyMove) Sender() string {
+	return m.Player.Username
+}
+
+// Validate checks that the move names a real location and that every unit
+// moved is one of the player's, now at that location.
+func (m ArmyMove) Validate() error {
+	if err := m.Player.Validate(); err != nil {
+		return err
+	}
+	if _, ok := getAllLocations()[m.ToLocation]; !ok {
+		return fmt.Errorf("%s is not a valid location", m.ToLocation)
+	}
+	if len(m.Units) == 0 {
+		return errors.New("move has no units")
+	}
+	for _, u := range m.Units {
+		if err := u.Validate(); err != nil {
+			return err
+		}
+		if u.Location != m.ToLocation {
+			return fmt.Errorf("unit %d is in %s, not %s", u.ID, u.Location, m.ToLocation)
+		}
+		if _, ok := m.Player.Units[u.ID]; !ok {
+			return fmt.Errorf("unit %d does not belong to %s", u.ID, m.Player.Username)
+		}
+	}
+	return nil
+}
+
 type RecognitionOfWar struct {
 	Attacker Player
 	Defender Player
 }
 
+// Sender is the attacker, who declares the war.
+func (w RecognitionOfWar) Sender() string {
+	return w.Attacker.Username
+}
+
+func (w RecognitionOfWar) Validate() error {
+	if err := w.Attacker.Validate(); err != nil {
+		return fmt.Errorf("attacker: %w", err)
+	}
+	if err := w.Defender.Validate(); err != nil {
+		return fmt.Errorf("defender: %w", err)
+	}
+	if w.Attacker.Username == w.Defender.Username {
+		return fmt.Errorf("%s can not go to war with themselves", w.Attacker.Username)
+	}
+	return nil
+}
+
+// Validate checks the player has a name and that its units are keyed by
+// their own IDs.
+func (p Player) Validate() error {
+	if p.Username == "" {
+		return errors.New("player has no username")
+	}
+	for id, u := range p.Units {
+		if err := u.Validate(); err != nil {
+			return err
+		}
+		if id != u.ID {
+			return fmt.Errorf("unit %d is stored under ID %d", u.ID, id)
+		}
+	}
+	return nil
+}
+
+func (u Unit) Validate() error {
+	if u.ID < 1 {
+		return fmt.Errorf("unit ID %d is not positive", u.ID)
+	}
+	if _, ok := getAllRanks()[u.Rank]; !ok {
+		return fmt.Errorf("unit %d has invalid rank '%s'", u.ID, u.Rank)
+	}
+	if _, ok := getAllLocations()[u.Location]; !ok {
+		return fmt.Errorf("unit %d is in invalid location '%s'", u.ID, u.Location)
+	}
+	return nil
+}
+
 type Location string
 
 func getAllRanks() map[UnitRank]struct{} {
@@ -49,7 +49,19 @@ func getOverlappingLocation(p1 Player, p2 Player) Location {
 	return ""
 }
 
+// CommandMove moves units as PlanMove describes and returns the move.
 func (gs *GameState) CommandMove(words []string) (ArmyMove, error) {
+	mv, err := gs.PlanMove(words)
+	if err != nil {
+		return ArmyMove{}, err
+	}
+	gs.ApplyMove(mv)
+	return mv, nil
+}
+
+// PlanMove parses a move command into the move it would make, without
+// moving any units.
+func (gs *GameState) PlanMove(words []string) (ArmyMove, error) {
 	if gs.isPaused() {
 		return ArmyMove{}, errors.New("the game is paused, you can not move units")
 	}
@@ -71,22 +83,29 @@ func (gs *GameState) CommandMove(words []string) (ArmyMove, error) {
 		unitIDs = append(unitIDs, unitID)
 	}
 
+	player := gs.GetPlayerSnap()
 	newUnits := []Unit{}
 	for _, unitID := range unitIDs {
-		unit, ok := gs.GetUnit(unitID)
+		unit, ok := player.Units[unitID]
 		if !ok {
 			return ArmyMove{}, fmt.Errorf("error: unit with ID %v not found", unitID)
 		}
 		unit.Location = newLocation
-		gs.UpdateUnit(unit)
+		player.Units[unitID] = unit
 		newUnits = append(newUnits, unit)
 	}
 
-	mv := ArmyMove{
+	return ArmyMove{
 		ToLocation: newLocation,
 		Units:      newUnits,
-		Player:     gs.GetPlayerSnap(),
+		Player:     player,
+	}, nil
+}
+
+// ApplyMove moves the player's units as a planned move says.
+func (gs *GameState) ApplyMove(mv ArmyMove) {
+	for _, unit := range mv.Units {
+		gs.UpdateUnit(unit)
 	}
 	fmt.Printf("Moved %v units to %s\n", len(mv.Units), mv.ToLocation)
-	return mv, nil
 }
@@ -14,7 +14,24 @@ const (
 	WarOutcomeDraw
 )
 
+// WarResult is how a war turns out for the player resolving it.
+type WarResult struct {
+	Outcome WarOutcome
+	Winner  string
+	Loser   string
+	// Casualties is where the player's units die, if they lose or draw.
+	Casualties Location
+}
+
+// HandleWar resolves a war as PlanWar describes and applies the result.
 func (gs *GameState) HandleWar(rw RecognitionOfWar) (outcome WarOutcome, winner string, loser string) {
+	war := gs.PlanWar(rw)
+	gs.ApplyWar(war)
+	return war.Outcome, war.Winner, war.Loser
+}
+
+// PlanWar works out how a war turns out, without killing any units.
+func (gs *GameState) PlanWar(rw RecognitionOfWar) WarResult {
 	defer fmt.Println("------------------------")
 	fmt.Println()
 	fmt.Println("==== War Declared ====")
@@ -24,18 +41,18 @@ func (gs *GameState) HandleWar(rw RecognitionOfWar) (outcome WarOutcome, winner
 
 	if player.Username == rw.Defender.Username {
 		fmt.Printf("%s, you published the war.\n", player.Username)
-		return WarOutcomeNotInvolved, "", ""
+		return WarResult{Outcome: WarOutcomeNotInvolved}
 	}
 
 	if player.Username != rw.Attacker.Username {
 		fmt.Printf("%s, you are not involved in this war.\n", player.Username)
-		return WarOutcomeNotInvolved, "", ""
+		return WarResult{Outcome: WarOutcomeNotInvolved}
 	}
 
 	overlappingLocation := getOverlappingLocation(rw.Attacker, rw.Defender)
 	if overlappingLocation == "" {
 		fmt.Printf("Error! No units are in the same location. No war will be fought.\n")
-		return WarOutcomeNoUnits, "", ""
+		return WarResult{Outcome: WarOutcomeNoUnits}
 	}
 
 	attackerUnits := []Unit{}
@@ -67,25 +84,28 @@ func (gs *GameState) HandleWar(rw RecognitionOfWar) (outcome WarOutcome, winner
 		fmt.Printf("%s has won the war!\n", rw.Attacker.Username)
 		if player.Username == rw.Defender.Username {
 			fmt.Println("You have lost the war!")
-			gs.removeUnitsInLocation(overlappingLocation)
-			fmt.Printf("Your units in %s have been killed.\n", overlappingLocation)
-			return WarOutcomeOpponentWon, rw.Attacker.Username, rw.Defender.Username
+			return WarResult{WarOutcomeOpponentWon, rw.Attacker.Username, rw.Defender.Username, overlappingLocation}
 		}
-		return WarOutcomeYouWon, rw.Attacker.Username, rw.Defender.Username
+		return WarResult{WarOutcomeYouWon, rw.Attacker.Username, rw.Defender.Username, ""}
 	} else if defenderPower > attackerPower {
 		fmt.Printf("%s has won the war!\n", rw.Defender.Username)
 		if player.Username == rw.Attacker.Username {
 			fmt.Println("You have lost the war!")
-			gs.removeUnitsInLocation(overlappingLocation)
-			fmt.Printf("Your units in %s have been killed.\n", overlappingLocation)
-			return WarOutcomeOpponentWon, rw.Defender.Username, rw.Attacker.Username
+			return WarResult{WarOutcomeOpponentWon, rw.Defender.Username, rw.Attacker.Username, overlappingLocation}
 		}
-		return WarOutcomeYouWon, rw.Defender.Username, rw.Attacker.Username
+		return WarResult{WarOutcomeYouWon, rw.Defender.Username, rw.Attacker.Username, ""}
 	}
 	fmt.Println("The war ended in a draw!")
-	fmt.Printf("Your units in %s have been killed.\n", overlappingLocation)
-	gs.removeUnitsInLocation(overlappingLocation)
-	return WarOutcomeDraw, rw.Attacker.Username, rw.Defender.Username
+	return WarResult{WarOutcomeDraw, rw.Attacker.Username, rw.Defender.Username, overlappingLocation}
+}
+
+// ApplyWar kills the player's units a planned war cost them.
+func (gs *GameState) ApplyWar(war WarResult) {
+	if war.Casualties == "" {
+		return
+	}
+	gs.removeUnitsInLocation(war.Casualties)
+	fmt.Printf("Your units in %s have been killed.\n", war.Casualties)
 }
 
 func unitsToPowerLevel(units []Unit) int {
@@ -0,0 +1,48 @@
+package pubsub
+
+import (
+	"context"
+
+	amqp "github.com/rabbitmq/amqp091-go"
+)
+
+// Publisher is the publishing half of an AMQP channel.
+type Publisher interface {
+	PublishWithContext(ctx context.Context, exchange, key string, mandatory, immediate bool, msg amqp.Publishing) error
+}
+
+// Channel is the subset of *amqp.Channel used by this package.
+type Channel interface {
+	Publisher
+	ExchangeDeclare(name, kind string, durable, autoDelete, internal, noWait bool, args amqp.Table) error
+	QueueDeclare(name string, durable, autoDelete, exclusive, noWait bool, args amqp.Table) (amqp.Queue, error)
+	QueueBind(name, key, exchange string, noWait bool, args amqp.Table) error
+	Qos(prefetchCount, prefetchSize int, global bool) error
+	Consume(queue, consumer string, autoAck, exclusive, noLocal, noWait bool, args amqp.Table) (<-chan amqp.Delivery, error)
+	Cancel(consumer string, noWait bool) error
+	Confirm(noWait bool) error
+	NotifyPublish(confirm chan amqp.Confirmation) chan amqp.Confirmation
+	Close() error
+}
+
+// Subscriber opens channels, like *amqp.Connection does.
+type Subscriber interface {
+	Channel() (Channel, error)
+}
+
+type amqpConn struct {
+	conn *amqp.Connection
+}
+
+// FromConnection adapts a live RabbitMQ connection to a Subscriber.
+func FromConnection(conn *amqp.Connection) Subscriber {
+	return amqpConn{conn: conn}
+}
+
+func (c amqpConn) Channel() (Channel, error) {
+	ch, err := c.conn.Channel()
+	if err != nil {
+		return nil, err
+	}
+	return ch, nil
+}
@@ -0,0 +1,125 @@
+package pubsub
+
+import (
+	"bytes"
+	"encoding/gob"
+	"encoding/json"
+	"fmt"
+	"sync"
+
+	amqp "github.com/rabbitmq/amqp091-go"
+	"github.com/vmihailenco/msgpack/v5"
+)
+
+// Codec turns values into message bodies and back. Subscriptions pick the
+// codec for each delivery from its ContentType, so every codec in use must
+// be registered with RegisterCodec.
+type Codec interface {
+	ContentType() string
+	Marshal(v any) ([]byte, error)
+	Unmarshal(data []byte, v any) error
+}
+
+var (
+	JSON    Codec = jsonCodec{}
+	Gob     Codec = gobCodec{}
+	MsgPack Codec = msgpackCodec{}
+)
+
+var codecs = struct {
+	sync.RWMutex
+	byType map[string]Codec
+}{byType: map[string]Codec{}}
+
+func init() {
+	RegisterCodec(JSON)
+	RegisterCodec(Gob)
+	RegisterCodec(MsgPack)
+}
+
+// RegisterCodec makes c available for decoding deliveries with its content
+// type, replacing any codec already registered for it.
+func RegisterCodec(c Codec) {
+	codecs.Lock()
+	defer codecs.Unlock()
+	codecs.byType[c.ContentType()] = c
+}
+
+func CodecFor(contentType string) (Codec, bool) {
+	codecs.RLock()
+	defer codecs.RUnlock()
+	c, ok := codecs.byType[contentType]
+	return c, ok
+}
+
+// publishingCodec is a codec that wraps another and needs to set more of
+// the publishing than its body, such as its ContentEncoding or headers.
+type publishingCodec interface {
+	Codec
+	encode(v any, msg *amqp.Publishing) error
+}
+
+// encodeInto sets msg's body to v encoded with c.
+func encodeInto(c Codec, v any, msg *amqp.Publishing) error {
+	if pc, ok := c.(publishingCodec); ok {
+		return pc.encode(v, msg)
+	}
+	data, err := c.Marshal(v)
+	if err != nil {
+		return err
+	}
+	msg.Body = data
+	return nil
+}
+
+func decode[T any](contentType string, body []byte) (T, error) {
+	var val T
+	c, ok := CodecFor(contentType)
+	if !ok {
+		return val, fmt.Errorf("no codec registered for content type '%s'", contentType)
+	}
+	err := c.Unmarshal(body, &val)
+	return val, err
+}
+
+type jsonCodec struct{}
+
+func (jsonCodec) ContentType() string { return "application/json" }
+
+func (jsonCodec) Marshal(v any) ([]byte, error) {
+	return json.Marshal(v)
+}
+
+func (jsonCodec) Unmarshal(data []byte, v any) error {
+	return json.Unmarshal(data, v)
+}
+
+type gobCodec struct{}
+
+func (gobCodec) ContentType() string { return "application/gob" }
+
+func (gobCodec) Marshal(v any) ([]byte, error) {
+	var buf bytes.Buffer
+	enc := gob.NewEncoder(&buf)
+	if err := enc.Encode(v); err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
+
+func (gobCodec) Unmarshal(data []byte, v any) error {
+	dec := gob.NewDecoder(bytes.NewReader(data))
+	return dec.Decode(v)
+}
+
+type msgpackCodec struct{}
+
+func (msgpackCodec) ContentType() string { return "application/msgpack" }
+
+func (msgpackCodec) Marshal(v any) ([]byte, error) {
+	return msgpack.Marshal(v)
+}
+
+func (msgpackCodec) Unmarshal(data []byte, v any) error {
+	return msgpack.Unmarshal(data, v)
+}
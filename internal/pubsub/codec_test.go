@@ -0,0 +1,98 @@
+package pubsub
+
+import (
+	"context"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/bootdotdev/learn-pub-sub-starter/internal/routing"
+)
+
+func TestCodecRoundTrip(t *testing.T) {
+	want := routing.GameLog{CurrentTime: time.Now().Round(0), Message: "attack!", Username: "alice"}
+	for _, c := range []Codec{JSON, Gob, MsgPack} {
+		t.Run(c.ContentType(), func(t *testing.T) {
+			data, err := c.Marshal(want)
+			if err != nil {
+				t.Fatal(err)
+			}
+			var got routing.GameLog
+			if err := c.Unmarshal(data, &got); err != nil {
+				t.Fatal(err)
+			}
+			if got.Message != want.Message || got.Username != want.Username || !got.CurrentTime.Equal(want.CurrentTime) {
+				t.Errorf("got %+v, want %+v", got, want)
+			}
+		})
+	}
+}
+
+// upperCodec is JSON that upper-cases strings on the way out.
+type upperCodec struct{ jsonCodec }
+
+func (upperCodec) ContentType() string { return "application/x-test-upper" }
+
+func (c upperCodec) Unmarshal(data []byte, v any) error {
+	return c.jsonCodec.Unmarshal([]byte(strings.ToUpper(string(data))), v)
+}
+
+func TestCodecFor(t *testing.T) {
+	RegisterCodec(upperCodec{})
+	tests := []struct {
+		contentType string
+		want        Codec
+	}{
+		{"application/json", JSON},
+		{"application/gob", Gob},
+		{"application/msgpack", MsgPack},
+		{"application/x-test-upper", upperCodec{}},
+		{"text/plain", nil},
+		{"", nil},
+	}
+	for _, tt := range tests {
+		c, ok := CodecFor(tt.contentType)
+		if ok != (tt.want != nil) || c != tt.want {
+			t.Errorf("CodecFor(%q) = %v, %v, want %v", tt.contentType, c, ok, tt.want)
+		}
+	}
+}
+
+func TestSubscriptionDecodesEachCodec(t *testing.T) {
+	RegisterCodec(upperCodec{})
+	b := newTestBroker(t)
+	handled := make(chan routing.GameLog, 4)
+	sub, err := Subscribe(context.Background(), b, routing.ExchangePerilTopic, routing.GameLogSlug, routing.GameLogSlug+".*", DurableQueue,
+		func(gl routing.GameLog) SimpleAckType {
+			handled <- gl
+			return Ack
+		},
+	)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer sub.Close()
+
+	ch := testChannel(t, b)
+	codecs := []Codec{JSON, Gob, MsgPack, upperCodec{}}
+	for _, c := range codecs {
+		err := Publish(context.Background(), ch, routing.ExchangePerilTopic, "game_logs.alice", routing.GameLog{Message: "sent as " + c.ContentType()}, WithCodec(c))
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	got := map[string]bool{}
+	for range codecs {
+		select {
+		case gl := <-handled:
+			got[gl.Message] = true
+		case <-time.After(time.Second):
+			t.Fatalf("handled only %v", got)
+		}
+	}
+	for _, want := range []string{"sent as application/json", "sent as application/gob", "sent as application/msgpack", "SENT AS APPLICATION/X-TEST-UPPER"} {
+		if !got[want] {
+			t.Errorf("didn't handle %q; handled %v", want, got)
+		}
+	}
+}
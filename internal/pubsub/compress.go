@@ -0,0 +1,108 @@
+package pubsub
+
+import (
+	"bytes"
+	"compress/gzip"
+	"errors"
+	"fmt"
+	"io"
+
+	"github.com/golang/snappy"
+	amqp "github.com/rabbitmq/amqp091-go"
+)
+
+// Compression is a content encoding for message bodies.
+type Compression string
+
+const (
+	// Gzip compresses well and is understood everywhere.
+	Gzip Compression = "gzip"
+	// Snappy is several times faster than gzip but compresses less.
+	Snappy Compression = "snappy"
+)
+
+type compressedCodec struct {
+	Codec
+	compression Compression
+	threshold   int
+}
+
+// Compressed wraps base so that bodies of at least threshold bytes are
+// compressed and marked with a ContentEncoding. Subscriptions decompress
+// any delivery with a known encoding before decoding it, so only
+// publishers need to use the wrapper.
+func Compressed(base Codec, c Compression, threshold int) Codec {
+	return compressedCodec{Codec: base, compression: c, threshold: threshold}
+}
+
+func (c compressedCodec) encode(v any, msg *amqp.Publishing) error {
+	err := encodeInto(c.Codec, v, msg)
+	if err != nil {
+		return err
+	}
+	// Subscriptions decrypt before they decompress, and ciphertext doesn't
+	// compress anyway.
+	if _, ok := msg.Headers[HeaderEncryption]; ok {
+		return errors.New("compressed codec can't wrap an encrypted one: use Encrypted(Compressed(...))")
+	}
+	if len(msg.Body) < c.threshold {
+		return nil
+	}
+	switch c.compression {
+	case Gzip:
+		var buf bytes.Buffer
+		zw := gzip.NewWriter(&buf)
+		if _, err := zw.Write(msg.Body); err != nil {
+			return err
+		}
+		if err := zw.Close(); err != nil {
+			return err
+		}
+		msg.Body = buf.Bytes()
+	case Snappy:
+		msg.Body = snappy.Encode(nil, msg.Body)
+	default:
+		return fmt.Errorf("unknown compression '%s'", c.compression)
+	}
+	msg.ContentEncoding = string(c.compression)
+	return nil
+}
+
+// MaxDecompressedSize is the largest body a subscription will decompress.
+// Anything bigger is treated as undecodable, so a small message can't
+// expand into enough memory to bring the consumer down.
+const MaxDecompressedSize = 16 << 20
+
+var ErrDecompressedTooLarge = fmt.Errorf("decompressed body is larger than %d bytes", MaxDecompressedSize)
+
+func decompress(contentEncoding string, body []byte) ([]byte, error) {
+	switch contentEncoding {
+	case "", "identity":
+		return body, nil
+	case string(Gzip):
+		zr, err := gzip.NewReader(bytes.NewReader(body))
+		if err != nil {
+			return nil, err
+		}
+		defer zr.Close()
+		out, err := io.ReadAll(io.LimitReader(zr, MaxDecompressedSize+1))
+		if err != nil {
+			return nil, err
+		}
+		if len(out) > MaxDecompressedSize {
+			return nil, ErrDecompressedTooLarge
+		}
+		return out, nil
+	case string(Snappy):
+		n, err := snappy.DecodedLen(body)
+		if err != nil {
+			return nil, err
+		}
+		if n > MaxDecompressedSize {
+			return nil, ErrDecompressedTooLarge
+		}
+		return snappy.Decode(nil, body)
+	default:
+		return nil, fmt.Errorf("unknown content encoding '%s'", contentEncoding)
+	}
+}
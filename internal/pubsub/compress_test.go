@@ -0,0 +1,52 @@
+package pubsub
+
+import (
+	"bytes"
+	"compress/gzip"
+	"errors"
+	"testing"
+
+	"github.com/golang/snappy"
+)
+
+func TestDecompress(t *testing.T) {
+	small := bytes.Repeat([]byte("peril "), 100)
+	huge := make([]byte, MaxDecompressedSize+1)
+	gz := func(b []byte) []byte {
+		var buf bytes.Buffer
+		zw := gzip.NewWriter(&buf)
+		zw.Write(b)
+		zw.Close()
+		return buf.Bytes()
+	}
+	tests := []struct {
+		name     string
+		encoding string
+		body     []byte
+		want     []byte
+		wantErr  error
+	}{
+		{"identity", "", small, small, nil},
+		{"gzip", "gzip", gz(small), small, nil},
+		{"snappy", "snappy", snappy.Encode(nil, small), small, nil},
+		{"gzip bomb", "gzip", gz(huge), nil, ErrDecompressedTooLarge},
+		{"snappy bomb", "snappy", snappy.Encode(nil, huge), nil, ErrDecompressedTooLarge},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := decompress(tt.encoding, tt.body)
+			if tt.wantErr != nil {
+				if !errors.Is(err, tt.wantErr) {
+					t.Fatalf("got %v, want %v", err, tt.wantErr)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !bytes.Equal(got, tt.want) {
+				t.Errorf("got %d bytes, want %d", len(got), len(tt.want))
+			}
+		})
+	}
+}
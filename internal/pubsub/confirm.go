@@ -0,0 +1,172 @@
+package pubsub
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"sync"
+	"time"
+
+	amqp "github.com/rabbitmq/amqp091-go"
+)
+
+var ErrPublishNacked = errors.New("publish was nacked by the broker")
+
+// ConfirmChannel is a channel that can be put into publisher confirm mode.
+type ConfirmChannel interface {
+	Publisher
+	Confirm(noWait bool) error
+	NotifyPublish(confirm chan amqp.Confirmation) chan amqp.Confirmation
+}
+
+// ConfirmPublisher puts a channel into confirm mode and makes every publish
+// wait for the broker to ack it.
+type ConfirmPublisher struct {
+	ch      ConfirmChannel
+	timeout time.Duration
+
+	pubMu sync.Mutex
+	seq   uint64
+
+	pendMu  sync.Mutex
+	pending map[uint64]chan bool
+	gone    bool
+}
+
+func NewConfirmPublisher(ch ConfirmChannel, timeout time.Duration) (*ConfirmPublisher, error) {
+	if err := ch.Confirm(false); err != nil {
+		return nil, err
+	}
+	p := &ConfirmPublisher{
+		ch:      ch,
+		timeout: timeout,
+		pending: map[uint64]chan bool{},
+	}
+	go p.listen(ch.NotifyPublish(make(chan amqp.Confirmation, 64)))
+	return p, nil
+}
+
+func (p *ConfirmPublisher) listen(confirms chan amqp.Confirmation) {
+	for c := range confirms {
+		p.pendMu.Lock()
+		done, ok := p.pending[c.DeliveryTag]
+		delete(p.pending, c.DeliveryTag)
+		p.pendMu.Unlock()
+		if ok {
+			done <- c.Ack
+		}
+	}
+	p.pendMu.Lock()
+	defer p.pendMu.Unlock()
+	p.gone = true
+	for tag, done := range p.pending {
+		close(done)
+		delete(p.pending, tag)
+	}
+}
+
+func (p *ConfirmPublisher) publish(ctx context.Context, exchange, key string, mandatory, immediate bool, msg amqp.Publishing) (chan bool, error) {
+	p.pubMu.Lock()
+	defer p.pubMu.Unlock()
+
+	done := make(chan bool, 1)
+	p.pendMu.Lock()
+	if p.gone {
+		p.pendMu.Unlock()
+		return nil, amqp.ErrClosed
+	}
+	p.seq++
+	tag := p.seq
+	p.pending[tag] = done
+	p.pendMu.Unlock()
+
+	err := p.ch.PublishWithContext(ctx, exchange, key, mandatory, immediate, msg)
+	if err != nil {
+		p.pendMu.Lock()
+		delete(p.pending, tag)
+		p.pendMu.Unlock()
+		p.seq--
+		return nil, err
+	}
+	return done, nil
+}
+
+func (p *ConfirmPublisher) wait(ctx context.Context, done chan bool) error {
+	if p.timeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, p.timeout)
+		defer cancel()
+	}
+	select {
+	case ack, ok := <-done:
+		if !ok {
+			return amqp.ErrClosed
+		}
+		if !ack {
+			return ErrPublishNacked
+		}
+		return nil
+	case <-ctx.Done():
+		return fmt.Errorf("waiting for publisher confirm: %w", ctx.Err())
+	}
+}
+
+func (p *ConfirmPublisher) PublishWithContext(ctx context.Context, exchange, key string, mandatory, immediate bool, msg amqp.Publishing) error {
+	done, err := p.publish(ctx, exchange, key, mandatory, immediate, msg)
+	if err != nil {
+		return err
+	}
+	return p.wait(ctx, done)
+}
+
+// Batch returns a publisher that does not wait for each confirm; call Wait
+// once everything has been published. A batch is not safe for concurrent use.
+func (p *ConfirmPublisher) Batch() *ConfirmBatch {
+	return &ConfirmBatch{p: p}
+}
+
+type ConfirmBatch struct {
+	p       *ConfirmPublisher
+	pending []chan bool
+}
+
+func (b *ConfirmBatch) PublishWithContext(ctx context.Context, exchange, key string, mandatory, immediate bool, msg amqp.Publishing) error {
+	done, err := b.p.publish(ctx, exchange, key, mandatory, immediate, msg)
+	if err != nil {
+		return err
+	}
+	b.pending = append(b.pending, done)
+	return nil
+}
+
+// Wait blocks until every publish in the batch is confirmed and reports how
+// many were not.
+func (b *ConfirmBatch) Wait(ctx context.Context) error {
+	pending := b.pending
+	b.pending = nil
+	if b.p.timeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, b.p.timeout)
+		defer cancel()
+	}
+	failed := 0
+	var lastErr error
+	for _, done := range pending {
+		select {
+		case ack, ok := <-done:
+			if !ok {
+				failed++
+				lastErr = amqp.ErrClosed
+			} else if !ack {
+				failed++
+				lastErr = ErrPublishNacked
+			}
+		case <-ctx.Done():
+			return fmt.Errorf("waiting for publisher confirms: %w", ctx.Err())
+		}
+	}
+	if failed > 0 {
+		return fmt.Errorf("%d of %d publishes not confirmed: %w", failed, len(pending), lastErr)
+	}
+	return nil
+}
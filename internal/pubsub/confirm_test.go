@@ -0,0 +1,154 @@
+package pubsub
+
+import (
+	"context"
+	"errors"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	amqp "github.com/rabbitmq/amqp091-go"
+)
+
+// fakeConfirmChannel hands out delivery tags and lets the test decide how
+// each publish is confirmed.
+type fakeConfirmChannel struct {
+	mu        sync.Mutex
+	tag       uint64
+	confirms  chan amqp.Confirmation
+	published chan uint64
+}
+
+func newFakeConfirmChannel() *fakeConfirmChannel {
+	return &fakeConfirmChannel{published: make(chan uint64, 10)}
+}
+
+func (c *fakeConfirmChannel) Confirm(noWait bool) error { return nil }
+
+func (c *fakeConfirmChannel) NotifyPublish(confirm chan amqp.Confirmation) chan amqp.Confirmation {
+	c.confirms = confirm
+	return confirm
+}
+
+func (c *fakeConfirmChannel) PublishWithContext(ctx context.Context, exchange, key string, mandatory, immediate bool, msg amqp.Publishing) error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.tag++
+	c.published <- c.tag
+	return nil
+}
+
+// confirm answers the next publish.
+func (c *fakeConfirmChannel) confirm(t *testing.T, ack bool) {
+	t.Helper()
+	select {
+	case tag := <-c.published:
+		c.confirms <- amqp.Confirmation{DeliveryTag: tag, Ack: ack}
+	case <-time.After(time.Second):
+		t.Fatal("nothing was published")
+	}
+}
+
+func TestConfirmPublisher(t *testing.T) {
+	tests := []struct {
+		name    string
+		confirm func(t *testing.T, ch *fakeConfirmChannel)
+		want    error
+	}{
+		{"acked", func(t *testing.T, ch *fakeConfirmChannel) { ch.confirm(t, true) }, nil},
+		{"nacked", func(t *testing.T, ch *fakeConfirmChannel) { ch.confirm(t, false) }, ErrPublishNacked},
+		{"channel closed", func(t *testing.T, ch *fakeConfirmChannel) {
+			<-ch.published
+			close(ch.confirms)
+		}, amqp.ErrClosed},
+		{"never confirmed", func(t *testing.T, ch *fakeConfirmChannel) {}, context.DeadlineExceeded},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			ch := newFakeConfirmChannel()
+			p, err := NewConfirmPublisher(ch, 50*time.Millisecond)
+			if err != nil {
+				t.Fatal(err)
+			}
+			published := make(chan error, 1)
+			go func() {
+				published <- p.PublishWithContext(context.Background(), "", "q", false, false, amqp.Publishing{})
+			}()
+			tt.confirm(t, ch)
+			if err := <-published; !errors.Is(err, tt.want) {
+				t.Errorf("got %v, want %v", err, tt.want)
+			}
+		})
+	}
+}
+
+func TestConfirmPublisherAfterClose(t *testing.T) {
+	ch := newFakeConfirmChannel()
+	p, err := NewConfirmPublisher(ch, time.Second)
+	if err != nil {
+		t.Fatal(err)
+	}
+	close(ch.confirms)
+	waitFor(t, "publisher to notice the channel closed", func() bool {
+		p.pendMu.Lock()
+		defer p.pendMu.Unlock()
+		return p.gone
+	})
+	err = p.PublishWithContext(context.Background(), "", "q", false, false, amqp.Publishing{})
+	if !errors.Is(err, amqp.ErrClosed) {
+		t.Errorf("got %v, want ErrClosed", err)
+	}
+}
+
+func TestConfirmBatch(t *testing.T) {
+	ch := newFakeConfirmChannel()
+	p, err := NewConfirmPublisher(ch, time.Second)
+	if err != nil {
+		t.Fatal(err)
+	}
+	batch := p.Batch()
+	for range 3 {
+		if err := batch.PublishWithContext(context.Background(), "", "q", false, false, amqp.Publishing{}); err != nil {
+			t.Fatal(err)
+		}
+	}
+	ch.confirm(t, true)
+	ch.confirm(t, false)
+	ch.confirm(t, true)
+	err = batch.Wait(context.Background())
+	if !errors.Is(err, ErrPublishNacked) || !strings.HasPrefix(err.Error(), "1 of 3") {
+		t.Errorf("got %v, want 1 of 3 nacked", err)
+	}
+	// The batch starts over once waited on.
+	if err := batch.Wait(context.Background()); err != nil {
+		t.Errorf("waiting on an empty batch: %v", err)
+	}
+}
+
+func TestConfirmPublisherOnMemoryBroker(t *testing.T) {
+	b := NewMemoryBroker()
+	ch := testChannel(t, b)
+	if _, err := ch.QueueDeclare("work", true, false, false, false, nil); err != nil {
+		t.Fatal(err)
+	}
+	p, err := NewConfirmPublisher(ch.(ConfirmChannel), time.Second)
+	if err != nil {
+		t.Fatal(err)
+	}
+	batch := p.Batch()
+	for range 5 {
+		if err := batch.PublishWithContext(context.Background(), "", "work", false, false, amqp.Publishing{}); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := p.PublishWithContext(context.Background(), "", "work", false, false, amqp.Publishing{}); err != nil {
+		t.Fatal(err)
+	}
+	if err := batch.Wait(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	if n := b.QueueLen("work"); n != 6 {
+		t.Errorf("queue holds %d messages, want 6", n)
+	}
+}
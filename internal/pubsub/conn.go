@@ -0,0 +1,281 @@
+package pubsub
+
+import (
+	"context"
+	"errors"
+	"log/slog"
+	"math/rand"
+	"sync"
+	"time"
+
+	amqp "github.com/rabbitmq/amqp091-go"
+)
+
+// Conn is a RabbitMQ connection that survives broker restarts. When the
+// underlying connection drops it redials with backoff, re-declares every
+// queue and binding made through it, and lets subscriptions resume.
+// Publishing on a Conn is safe from any goroutine and blocks until the
+// connection is back.
+type Conn struct {
+	url            string
+	minBackoff     time.Duration
+	maxBackoff     time.Duration
+	confirmTimeout time.Duration
+	publishers     int
+	log            *slog.Logger
+
+	mu       sync.Mutex
+	conn     *amqp.Connection
+	ready    chan struct{}
+	closed   bool
+	done     chan struct{}
+	topology []declaration
+
+	pool *PublisherPool
+}
+
+type ConnOption func(*Conn)
+
+type declaration struct {
+	key     string
+	declare func(Channel) error
+}
+
+// topologyRecorder is implemented by connections that replay declarations
+// after reconnecting.
+type topologyRecorder interface {
+	recordTopology(key string, declare func(Channel) error)
+}
+
+// contextChanneler is implemented by connections that may have to wait to
+// open a channel.
+type contextChanneler interface {
+	channel(ctx context.Context) (Channel, error)
+}
+
+// openChannel opens a channel on conn, giving up when ctx is done if conn
+// would otherwise wait for the broker to come back.
+func openChannel(ctx context.Context, conn Subscriber) (Channel, error) {
+	if cc, ok := conn.(contextChanneler); ok {
+		return cc.channel(ctx)
+	}
+	return conn.Channel()
+}
+
+// reconnector is implemented by connections whose channels may come back
+// after being closed by the broker.
+type reconnector interface {
+	isClosed() bool
+}
+
+func WithReconnectBackoff(min, max time.Duration) ConnOption {
+	return func(c *Conn) {
+		c.minBackoff = min
+		c.maxBackoff = max
+	}
+}
+
+// WithPublisherConfirms makes every publish on the Conn wait up to timeout
+// for the broker to confirm it.
+func WithPublisherConfirms(timeout time.Duration) ConnOption {
+	return func(c *Conn) {
+		c.confirmTimeout = timeout
+	}
+}
+
+// WithPublishChannels sets how many channels the Conn publishes on at once.
+// The default is 4.
+func WithPublishChannels(n int) ConnOption {
+	return func(c *Conn) {
+		c.publishers = n
+	}
+}
+
+func Dial(url string, opts ...ConnOption) (*Conn, error) {
+	c := &Conn{
+		url:        url,
+		minBackoff: 500 * time.Millisecond,
+		maxBackoff: 30 * time.Second,
+		publishers: defaultPoolSize,
+		log:        silentLogger,
+		ready:      make(chan struct{}),
+		done:       make(chan struct{}),
+	}
+	for _, opt := range opts {
+		opt(c)
+	}
+	c.pool = newPublisherPool(c.channel, c.publishers, []PoolOption{WithPoolConfirms(c.confirmTimeout)})
+	conn, err := amqp.Dial(url)
+	if err != nil {
+		return nil, err
+	}
+	c.conn = conn
+	close(c.ready)
+	go c.watch(conn)
+	return c, nil
+}
+
+func (c *Conn) watch(conn *amqp.Connection) {
+	for {
+		closed := conn.NotifyClose(make(chan *amqp.Error, 1))
+		select {
+		case <-c.done:
+			return
+		case err := <-closed:
+			c.log.Warn("lost connection to RabbitMQ", "error", err)
+		}
+
+		c.mu.Lock()
+		if c.closed {
+			c.mu.Unlock()
+			return
+		}
+		c.conn = nil
+		c.ready = make(chan struct{})
+		c.mu.Unlock()
+
+		conn = c.redial()
+		if conn == nil {
+			return
+		}
+	}
+}
+
+func (c *Conn) redial() *amqp.Connection {
+	backoff := c.minBackoff
+	for attempt := 1; ; attempt++ {
+		select {
+		case <-c.done:
+			return nil
+		case <-time.After(jitter(backoff)):
+		}
+		conn, err := amqp.Dial(c.url)
+		if err == nil {
+			err = c.redeclare(conn)
+			if err == nil {
+				c.mu.Lock()
+				c.conn = conn
+				close(c.ready)
+				c.mu.Unlock()
+				c.log.Info("reconnected to RabbitMQ", "attempts", attempt)
+				return conn
+			}
+			conn.Close()
+		}
+		c.log.Warn("reconnect attempt failed", "attempt", attempt, "error", err)
+		backoff *= 2
+		if backoff > c.maxBackoff {
+			backoff = c.maxBackoff
+		}
+	}
+}
+
+func (c *Conn) redeclare(conn *amqp.Connection) error {
+	c.mu.Lock()
+	topology := append([]declaration(nil), c.topology...)
+	c.mu.Unlock()
+	if len(topology) == 0 {
+		return nil
+	}
+	ch, err := conn.Channel()
+	if err != nil {
+		return err
+	}
+	defer ch.Close()
+	for _, d := range topology {
+		if err := d.declare(ch); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func jitter(d time.Duration) time.Duration {
+	return d/2 + time.Duration(rand.Int63n(int64(d/2)+1))
+}
+
+func (c *Conn) recordTopology(key string, declare func(Channel) error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	for _, d := range c.topology {
+		if d.key == key {
+			return
+		}
+	}
+	c.topology = append(c.topology, declaration{key: key, declare: declare})
+}
+
+func (c *Conn) logger() *slog.Logger {
+	return c.log
+}
+
+func (c *Conn) isClosed() bool {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.closed
+}
+
+func (c *Conn) current(ctx context.Context) (*amqp.Connection, error) {
+	for {
+		c.mu.Lock()
+		if c.closed {
+			c.mu.Unlock()
+			return nil, amqp.ErrClosed
+		}
+		conn, ready := c.conn, c.ready
+		c.mu.Unlock()
+		if conn != nil && !conn.IsClosed() {
+			return conn, nil
+		}
+		select {
+		case <-ready:
+		case <-c.done:
+		case <-ctx.Done():
+			return nil, ctx.Err()
+		case <-time.After(c.minBackoff):
+		}
+	}
+}
+
+// Channel opens a channel, waiting for the connection to come back if it is
+// currently down.
+func (c *Conn) Channel() (Channel, error) {
+	return c.channel(context.Background())
+}
+
+func (c *Conn) channel(ctx context.Context) (Channel, error) {
+	for {
+		conn, err := c.current(ctx)
+		if err != nil {
+			return nil, err
+		}
+		ch, err := conn.Channel()
+		if err == nil {
+			return ch, nil
+		}
+		if !errors.Is(err, amqp.ErrClosed) {
+			return nil, err
+		}
+	}
+}
+
+func (c *Conn) PublishWithContext(ctx context.Context, exchange, key string, mandatory, immediate bool, msg amqp.Publishing) error {
+	return c.pool.PublishWithContext(ctx, exchange, key, mandatory, immediate, msg)
+}
+
+func (c *Conn) Close() error {
+	c.mu.Lock()
+	if c.closed {
+		c.mu.Unlock()
+		return nil
+	}
+	c.closed = true
+	close(c.done)
+	conn := c.conn
+	c.mu.Unlock()
+	c.pool.Close()
+	if conn == nil {
+		return nil
+	}
+	return conn.Close()
+}
@@ -0,0 +1,105 @@
+package pubsub
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/bootdotdev/learn-pub-sub-starter/internal/routing"
+)
+
+// recordingBroker is a memory broker that records declarations on a Conn
+// the way a managed connection does.
+type recordingBroker struct {
+	*MemoryBroker
+	conn *Conn
+}
+
+func (r recordingBroker) recordTopology(key string, declare func(Channel) error) {
+	r.conn.recordTopology(key, declare)
+}
+
+func TestConnReplaysRecordedTopology(t *testing.T) {
+	conn := &Conn{}
+	rb := recordingBroker{MemoryBroker: newTestBroker(t), conn: conn}
+	for range 2 {
+		ch, _, err := DeclareAndBind(rb, routing.ExchangePerilTopic, "logs", routing.GameLogSlug+".*", DurableQueue)
+		if err != nil {
+			t.Fatal(err)
+		}
+		ch.Close()
+	}
+	if len(conn.topology) != 1 {
+		t.Fatalf("recorded %d declarations, want 1", len(conn.topology))
+	}
+
+	// Replaying onto a broker that lost everything brings the queue and its
+	// binding back.
+	fresh := newTestBroker(t)
+	ch := testChannel(t, fresh)
+	for _, d := range conn.topology {
+		if err := d.declare(ch); err != nil {
+			t.Fatal(err)
+		}
+	}
+	err := PublishJSON(ch, routing.ExchangePerilTopic, routing.GameLogSlug+".alice", routing.GameLog{Username: "alice"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if n := fresh.QueueLen("logs"); n != 1 {
+		t.Errorf("replayed queue holds %d messages, want 1", n)
+	}
+}
+
+func TestSubscriptionResumesAfterReconnect(t *testing.T) {
+	conn := &flakyConn{MemoryBroker: newTestBroker(t)}
+	handled := make(chan routing.GameLog, 1)
+	sub, err := Subscribe(context.Background(), conn, routing.ExchangePerilTopic, "logs", routing.GameLogSlug+".*", TransientQueue,
+		func(gl routing.GameLog) SimpleAckType {
+			handled <- gl
+			return Ack
+		},
+	)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer sub.Close()
+
+	// Dropping the connection deletes the transient queue along with the
+	// channel, so the subscription has to declare it again.
+	exists := func() bool {
+		ch, err := conn.MemoryBroker.Channel()
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer ch.Close()
+		_, err = ch.(passiveChannel).QueueDeclarePassive("logs", false, true, true, false, nil)
+		return err == nil
+	}
+	conn.drop()
+	waitFor(t, "transient queue to go away", func() bool { return !exists() })
+	conn.restore()
+	waitFor(t, "subscription to redeclare its queue", exists)
+
+	err = PublishJSON(testChannel(t, conn.MemoryBroker), routing.ExchangePerilTopic, routing.GameLogSlug+".alice", routing.GameLog{Username: "alice"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	select {
+	case gl := <-handled:
+		if gl.Username != "alice" {
+			t.Errorf("handled %+v, want alice's log", gl)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("subscription didn't resume after the connection came back")
+	}
+}
+
+func TestJitter(t *testing.T) {
+	d := 100 * time.Millisecond
+	for range 100 {
+		if j := jitter(d); j < d/2 || j > d {
+			t.Fatalf("jitter(%v) = %v, want between %v and %v", d, j, d/2, d)
+		}
+	}
+}
@@ -0,0 +1,69 @@
+package pubsub
+
+import (
+	"context"
+
+	"github.com/bootdotdev/learn-pub-sub-starter/internal/routing"
+	amqp "github.com/rabbitmq/amqp091-go"
+)
+
+const (
+	HeaderDecodeError        = "x-decode-error"
+	HeaderExpectedType       = "x-expected-type"
+	HeaderOriginalExchange   = "x-original-exchange"
+	HeaderOriginalRoutingKey = "x-original-routing-key"
+)
+
+// deadLetter copies d to the dead letter exchange with extra headers
+// explaining why, then acks the original. Plain nacks can't carry headers,
+// so a nack without requeue is only the fallback for when the copy can't be
+// published; the queue's own x-dead-letter-exchange still catches it then.
+func deadLetter(ctx context.Context, ch Publisher, d amqp.Delivery, headers amqp.Table) {
+	pub := publishingFrom(d)
+	for k, v := range headers {
+		pub.Headers[k] = v
+	}
+	if _, ok := pub.Headers[HeaderOriginalExchange]; !ok {
+		pub.Headers[HeaderOriginalExchange] = d.Exchange
+		pub.Headers[HeaderOriginalRoutingKey] = d.RoutingKey
+	}
+	key, _ := pub.Headers[HeaderOriginalRoutingKey].(string)
+	err := ch.PublishWithContext(
+		ctx,
+		routing.ExchangePerilDeadLetter,
+		key,
+		false,
+		false,
+		pub,
+	)
+	if err != nil {
+		d.Nack(false, false)
+		return
+	}
+	d.Ack(false)
+}
+
+// publishingFrom rebuilds the publishing a delivery was made from. The
+// headers are copied so they can be changed without touching d.
+func publishingFrom(d amqp.Delivery) amqp.Publishing {
+	headers := amqp.Table{}
+	for k, v := range d.Headers {
+		headers[k] = v
+	}
+	return amqp.Publishing{
+		Headers:         headers,
+		ContentType:     d.ContentType,
+		ContentEncoding: d.ContentEncoding,
+		DeliveryMode:    d.DeliveryMode,
+		Priority:        d.Priority,
+		CorrelationId:   d.CorrelationId,
+		ReplyTo:         d.ReplyTo,
+		Expiration:      d.Expiration,
+		MessageId:       d.MessageId,
+		Timestamp:       d.Timestamp,
+		Type:            d.Type,
+		UserId:          d.UserId,
+		AppId:           d.AppId,
+		Body:            d.Body,
+	}
+}
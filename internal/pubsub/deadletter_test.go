@@ -0,0 +1,78 @@
+package pubsub
+
+import (
+	"context"
+	"testing"
+
+	"github.com/bootdotdev/learn-pub-sub-starter/internal/routing"
+	amqp "github.com/rabbitmq/amqp091-go"
+)
+
+func TestUndecodableDeliveriesAreDeadLettered(t *testing.T) {
+	tests := []struct {
+		name        string
+		contentType string
+		body        string
+	}{
+		{"bad body", "application/json", "{not json"},
+		{"unknown content type", "text/plain", "hello"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			b := newTestBroker(t)
+			decodeErrs := make(chan error, 1)
+			sub, err := Subscribe(context.Background(), b, routing.ExchangePerilTopic, routing.GameLogSlug, routing.GameLogSlug+".*", DurableQueue,
+				func(gl routing.GameLog) SimpleAckType {
+					t.Errorf("handler got %+v", gl)
+					return Ack
+				},
+				WithDecodeErrorHandler(func(d amqp.Delivery, err error) { decodeErrs <- err }),
+			)
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer sub.Close()
+
+			ch := testChannel(t, b)
+			dead, err := ch.Consume(routing.DeadLetterQueue, "", true, false, false, false, nil)
+			if err != nil {
+				t.Fatal(err)
+			}
+			err = ch.PublishWithContext(context.Background(), routing.ExchangePerilTopic, "game_logs.alice", false, false, amqp.Publishing{
+				ContentType: tt.contentType,
+				MessageId:   "m1",
+				Body:        []byte(tt.body),
+			})
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			d := next(t, dead)
+			if string(d.Body) != tt.body || d.MessageId != "m1" {
+				t.Errorf("dead letter is %q with ID %q, want the original", d.Body, d.MessageId)
+			}
+			headers := map[string]any{
+				HeaderExpectedType:       "routing.GameLog",
+				HeaderOriginalExchange:   routing.ExchangePerilTopic,
+				HeaderOriginalRoutingKey: "game_logs.alice",
+			}
+			for k, want := range headers {
+				if got := d.Headers[k]; got != want {
+					t.Errorf("header %s = %v, want %v", k, got, want)
+				}
+			}
+			if msg, _ := d.Headers[HeaderDecodeError].(string); msg == "" {
+				t.Error("dead letter doesn't say why it couldn't be decoded")
+			}
+			if err := <-decodeErrs; err == nil {
+				t.Error("decode error handler got a nil error")
+			}
+			// Unacked deliveries go back on the queue when the subscription
+			// closes its channel.
+			sub.Close()
+			if n := b.QueueLen(routing.GameLogSlug); n != 0 {
+				t.Errorf("original was left on the queue %d times", n)
+			}
+		})
+	}
+}
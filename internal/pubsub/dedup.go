@@ -0,0 +1,275 @@
+package pubsub
+
+import (
+	"bufio"
+	"container/list"
+	"context"
+	"errors"
+	"fmt"
+	"os"
+	"strings"
+	"sync"
+)
+
+// DedupStore remembers the IDs of messages that have already been handled.
+// A worker claims an ID before handling its message, so two deliveries of
+// the same message running at once aren't both handled.
+type DedupStore interface {
+	// Claim reserves id for the caller, reporting false if it has already
+	// been handled. If another caller holds id, Claim waits until they mark
+	// or release it, or ctx is done.
+	Claim(ctx context.Context, id string) (bool, error)
+	// Mark records a claimed id as handled.
+	Mark(id string) error
+	// Release gives up a claim without recording id, so it can be handled
+	// again.
+	Release(id string) error
+}
+
+// WithDeduplication skips messages whose MessageId is already in store,
+// acking them without calling the handler. A message is recorded once the
+// handler acks it; requeued and discarded messages will be handled again if
+// they come back. Messages without an ID are always handled.
+func WithDeduplication(store DedupStore) SubscribeOption {
+	return func(o *subscribeOptions) {
+		o.dedup = store
+	}
+}
+
+// LRUStore keeps the most recent size IDs in memory.
+type LRUStore struct {
+	mu     sync.Mutex
+	size   int
+	order  *list.List
+	ids    map[string]*list.Element
+	claims map[string]chan struct{}
+}
+
+func NewLRUStore(size int) *LRUStore {
+	return &LRUStore{
+		size:   size,
+		order:  list.New(),
+		ids:    map[string]*list.Element{},
+		claims: map[string]chan struct{}{},
+	}
+}
+
+// Seen reports whether id has been handled.
+func (s *LRUStore) Seen(id string) (bool, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	e, ok := s.ids[id]
+	if ok {
+		s.order.MoveToFront(e)
+	}
+	return ok, nil
+}
+
+func (s *LRUStore) Claim(ctx context.Context, id string) (bool, error) {
+	for {
+		s.mu.Lock()
+		done, busy := s.claims[id]
+		if !busy {
+			defer s.mu.Unlock()
+			if e, ok := s.ids[id]; ok {
+				s.order.MoveToFront(e)
+				return false, nil
+			}
+			s.claims[id] = make(chan struct{})
+			return true, nil
+		}
+		s.mu.Unlock()
+		select {
+		case <-done:
+		case <-ctx.Done():
+			return false, ctx.Err()
+		}
+	}
+}
+
+func (s *LRUStore) Mark(id string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.add(id)
+	s.release(id)
+	return nil
+}
+
+func (s *LRUStore) Release(id string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.release(id)
+	return nil
+}
+
+// release must be called with s.mu held.
+func (s *LRUStore) release(id string) {
+	if done, ok := s.claims[id]; ok {
+		close(done)
+		delete(s.claims, id)
+	}
+}
+
+func (s *LRUStore) add(id string) {
+	if e, ok := s.ids[id]; ok {
+		s.order.MoveToFront(e)
+		return
+	}
+	s.ids[id] = s.order.PushFront(id)
+	for s.order.Len() > s.size {
+		oldest := s.order.Back()
+		s.order.Remove(oldest)
+		delete(s.ids, oldest.Value.(string))
+	}
+}
+
+// recent returns the stored IDs, oldest first.
+func (s *LRUStore) recent() []string {
+	ids := make([]string, 0, s.order.Len())
+	for e := s.order.Back(); e != nil; e = e.Prev() {
+		ids = append(ids, e.Value.(string))
+	}
+	return ids
+}
+
+var ErrDedupStoreLocked = errors.New("dedup store is in use by another process")
+
+// FileStore is an LRUStore that also appends every ID to a file, so that a
+// restarted process still recognises what it handled before. The file is
+// locked while the store is open, so each process needs a file of its own,
+// and a FileStore only dedups within one process: a message redelivered to
+// another process sharing the queue is handled again there.
+type FileStore struct {
+	lru    *LRUStore
+	mu     sync.Mutex
+	f      *os.File
+	path   string
+	size   int
+	lines  int
+	unlock func() error
+}
+
+// OpenFileStore loads the IDs recorded at path, keeping the most recent
+// size of them, and rewrites the file with just those. It fails with
+// ErrDedupStoreLocked if another FileStore has path open.
+func OpenFileStore(path string, size int) (*FileStore, error) {
+	unlock, err := lockFile(path + ".lock")
+	if err != nil {
+		return nil, err
+	}
+	s, err := openFileStore(path, size)
+	if err != nil {
+		unlock()
+		return nil, err
+	}
+	s.unlock = unlock
+	return s, nil
+}
+
+func openFileStore(path string, size int) (*FileStore, error) {
+	s := &FileStore{lru: NewLRUStore(size), path: path, size: size}
+	f, err := os.Open(path)
+	if err != nil && !os.IsNotExist(err) {
+		return nil, err
+	}
+	if err == nil {
+		sc := bufio.NewScanner(f)
+		for sc.Scan() {
+			if id := strings.TrimSpace(sc.Text()); id != "" {
+				s.lru.add(id)
+			}
+		}
+		f.Close()
+		if err := sc.Err(); err != nil {
+			return nil, fmt.Errorf("reading dedup store %s: %w", path, err)
+		}
+	}
+	err = s.compact()
+	if err != nil {
+		return nil, err
+	}
+	return s, nil
+}
+
+// compact rewrites the file with just the IDs in the LRU, so it doesn't
+// grow without bound. It must be called with s.mu held.
+func (s *FileStore) compact() error {
+	ids := s.lru.recent()
+	tmp := s.path + ".tmp"
+	out, err := os.Create(tmp)
+	if err != nil {
+		return err
+	}
+	w := bufio.NewWriter(out)
+	for _, id := range ids {
+		fmt.Fprintln(w, id)
+	}
+	err = w.Flush()
+	if err == nil {
+		err = out.Close()
+	} else {
+		out.Close()
+	}
+	if err != nil {
+		return err
+	}
+	err = os.Rename(tmp, s.path)
+	if err != nil {
+		return err
+	}
+	f, err := os.OpenFile(s.path, os.O_APPEND|os.O_WRONLY, 0644)
+	if err != nil {
+		return err
+	}
+	if s.f != nil {
+		s.f.Close()
+	}
+	s.f = f
+	s.lines = len(ids)
+	return nil
+}
+
+// Seen reports whether id has been handled.
+func (s *FileStore) Seen(id string) (bool, error) {
+	return s.lru.Seen(id)
+}
+
+func (s *FileStore) Claim(ctx context.Context, id string) (bool, error) {
+	return s.lru.Claim(ctx, id)
+}
+
+func (s *FileStore) Release(id string) error {
+	return s.lru.Release(id)
+}
+
+// Mark records id, compacting the file once it holds twice as many IDs as
+// the store keeps.
+func (s *FileStore) Mark(id string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	_, err := fmt.Fprintln(s.f, id)
+	if err != nil {
+		return fmt.Errorf("writing dedup store %s: %w", s.path, err)
+	}
+	s.lines++
+	err = s.lru.Mark(id)
+	if err != nil || s.lines <= 2*s.size {
+		return err
+	}
+	err = s.compact()
+	if err != nil {
+		return fmt.Errorf("compacting dedup store %s: %w", s.path, err)
+	}
+	return nil
+}
+
+func (s *FileStore) Close() error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	err := s.f.Close()
+	if s.unlock != nil {
+		s.unlock()
+		s.unlock = nil
+	}
+	return err
+}
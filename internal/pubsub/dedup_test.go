@@ -0,0 +1,179 @@
+package pubsub
+
+import (
+	"context"
+	"errors"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/bootdotdev/learn-pub-sub-starter/internal/routing"
+)
+
+func TestLRUStoreEvictsOldest(t *testing.T) {
+	s := NewLRUStore(2)
+	for _, id := range []string{"a", "b", "c"} {
+		s.Mark(id)
+	}
+	for id, want := range map[string]bool{"a": false, "b": true, "c": true} {
+		if seen, _ := s.Seen(id); seen != want {
+			t.Errorf("Seen(%s) = %v, want %v", id, seen, want)
+		}
+	}
+}
+
+func TestLRUStoreClaim(t *testing.T) {
+	tests := []struct {
+		name        string
+		finish      func(s *LRUStore, id string) error
+		wantClaimed bool
+	}{
+		{"marked", (*LRUStore).Mark, false},
+		{"released", (*LRUStore).Release, true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			s := NewLRUStore(10)
+			ok, err := s.Claim(context.Background(), "a")
+			if err != nil || !ok {
+				t.Fatalf("first claim got %v, %v", ok, err)
+			}
+			claimed := make(chan bool, 1)
+			go func() {
+				ok, _ := s.Claim(context.Background(), "a")
+				claimed <- ok
+			}()
+			select {
+			case <-claimed:
+				t.Fatal("second claim didn't wait for the first")
+			case <-time.After(20 * time.Millisecond):
+			}
+			tt.finish(s, "a")
+			select {
+			case ok := <-claimed:
+				if ok != tt.wantClaimed {
+					t.Errorf("second claim got %v, want %v", ok, tt.wantClaimed)
+				}
+			case <-time.After(time.Second):
+				t.Fatal("second claim still waiting")
+			}
+		})
+	}
+}
+
+func TestLRUStoreClaimGivesUp(t *testing.T) {
+	s := NewLRUStore(10)
+	s.Claim(context.Background(), "a")
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Millisecond)
+	defer cancel()
+	_, err := s.Claim(ctx, "a")
+	if !errors.Is(err, context.DeadlineExceeded) {
+		t.Errorf("got %v, want context.DeadlineExceeded", err)
+	}
+}
+
+func TestFileStoreSurvivesReopen(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "dedup.log")
+	s, err := OpenFileStore(path, 10)
+	if err != nil {
+		t.Fatal(err)
+	}
+	s.Mark("a")
+	s.Mark("b")
+	if err := s.Close(); err != nil {
+		t.Fatal(err)
+	}
+	s, err = OpenFileStore(path, 10)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer s.Close()
+	for _, id := range []string{"a", "b"} {
+		if seen, _ := s.Seen(id); !seen {
+			t.Errorf("%s forgotten after reopening", id)
+		}
+	}
+}
+
+func TestFileStoreCompacts(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "dedup.log")
+	s, err := OpenFileStore(path, 3)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer s.Close()
+	for i := 0; i < 100; i++ {
+		err := s.Mark(string(rune('a' + i%26)))
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	data, err := os.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if n := strings.Count(string(data), "\n"); n > 6 {
+		t.Errorf("file holds %d IDs, want at most 6", n)
+	}
+	if seen, _ := s.Seen(string(rune('a' + 99%26))); !seen {
+		t.Error("latest ID lost in compaction")
+	}
+}
+
+func TestFileStoreLocked(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "dedup.log")
+	s, err := OpenFileStore(path, 10)
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = OpenFileStore(path, 10)
+	if !errors.Is(err, ErrDedupStoreLocked) {
+		t.Fatalf("second open got %v, want ErrDedupStoreLocked", err)
+	}
+	s.Close()
+	s, err = OpenFileStore(path, 10)
+	if err != nil {
+		t.Fatalf("reopening after Close: %v", err)
+	}
+	s.Close()
+}
+
+// Copies of a message delivered to several workers at once are handled
+// once.
+func TestDeduplicationSkipsHandledMessages(t *testing.T) {
+	b := newTestBroker(t)
+	var calls atomic.Int32
+	sub, err := Subscribe(context.Background(), b, routing.ExchangePerilTopic, routing.GameLogSlug, routing.GameLogSlug+".*", DurableQueue,
+		func(gl routing.GameLog) SimpleAckType {
+			calls.Add(1)
+			time.Sleep(10 * time.Millisecond)
+			return Ack
+		},
+		WithConcurrency(3),
+		WithDeduplication(NewLRUStore(10)),
+	)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer sub.Close()
+	msg, err := newPublishing(context.Background(), routing.GameLog{Username: "alice"}, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	pub := testChannel(t, b)
+	for i := 0; i < 3; i++ {
+		err := pub.PublishWithContext(context.Background(), routing.ExchangePerilTopic, "game_logs.alice", false, false, msg)
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	waitFor(t, "queue to drain", func() bool { return b.QueueLen(routing.GameLogSlug) == 0 })
+	// Give the last delivery time to be handled, if it was going to be.
+	time.Sleep(20 * time.Millisecond)
+	if n := calls.Load(); n != 1 {
+		t.Errorf("handler called %d times for one message ID, want 1", n)
+	}
+}
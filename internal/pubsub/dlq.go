@@ -0,0 +1,248 @@
+package pubsub
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"time"
+
+	amqp "github.com/rabbitmq/amqp091-go"
+)
+
+// DeadLetter is a message sitting in a dead-letter queue.
+type DeadLetter struct {
+	Delivery amqp.Delivery
+	// Reason is why the message was dead-lettered: the broker's x-death
+	// reason, or decode, signature, validation or retries when a
+	// subscription dead-lettered it itself.
+	Reason string
+	// Error is the error a subscription recorded, if any.
+	Error string
+	// Queue is the queue the message was dead-lettered from, if the broker
+	// did it.
+	Queue string
+	// Exchange and RoutingKey are where the message was first published.
+	Exchange   string
+	RoutingKey string
+	// Count is how many times the broker has dead-lettered the message.
+	Count int64
+	Time  time.Time
+}
+
+// DeadLetterFrom reads the dead-lettering headers of a delivery. A reason a
+// subscription recorded wins over x-death: a message that ran out of
+// retries also carries the x-death of its last wait in a retry queue, which
+// only says it expired there.
+func DeadLetterFrom(d amqp.Delivery) DeadLetter {
+	dl := DeadLetter{Delivery: d}
+	for _, h := range []struct{ header, reason string }{
+		{HeaderDecodeError, "decode"},
+		{HeaderSignatureError, "signature"},
+		{HeaderValidationError, "validation"},
+	} {
+		if msg, ok := d.Headers[h.header].(string); ok {
+			dl.Reason = h.reason
+			dl.Error = msg
+			break
+		}
+	}
+	if _, ok := d.Headers[HeaderRetryAttempt]; ok && dl.Reason == "" {
+		dl.Reason = "retries"
+	}
+	if deaths, ok := d.Headers["x-death"].([]any); ok && len(deaths) > 0 && dl.Reason == "" {
+		// The most recent death comes first.
+		if death, ok := deaths[0].(amqp.Table); ok {
+			dl.Reason, _ = death["reason"].(string)
+			dl.Queue, _ = death["queue"].(string)
+			dl.Count, _ = tableInt(death["count"])
+			dl.Time, _ = death["time"].(time.Time)
+			dl.Exchange, _ = death["exchange"].(string)
+			if keys, ok := death["routing-keys"].([]any); ok && len(keys) > 0 {
+				dl.RoutingKey, _ = keys[0].(string)
+			}
+		}
+	}
+	// Subscriptions record where the message was first published. Retried
+	// messages came back through the default exchange, so x-death can't say.
+	if ex, ok := d.Headers[HeaderOriginalExchange].(string); ok {
+		dl.Exchange = ex
+		dl.RoutingKey, _ = d.Headers[HeaderOriginalRoutingKey].(string)
+	}
+	return dl
+}
+
+// DecodeDeadLetter decompresses the message's body and unmarshals it into v
+// with the codec for its content type. Encrypted bodies need keys.
+func DecodeDeadLetter(dl DeadLetter, keys KeySource, v any) error {
+	d := dl.Delivery
+	c, ok := CodecFor(d.ContentType)
+	if !ok {
+		return fmt.Errorf("no codec registered for content type '%s'", d.ContentType)
+	}
+	body, err := decrypt(keys, d, false)
+	if err == nil {
+		body, err = decompress(d.ContentEncoding, body)
+	}
+	if err != nil {
+		return err
+	}
+	return c.Unmarshal(body, v)
+}
+
+// deadLetterHeaders are added while a message is dead-lettered or retried,
+// and are dropped when it is replayed.
+var deadLetterHeaders = []string{
+	"x-death",
+	"x-first-death-exchange",
+	"x-first-death-queue",
+	"x-first-death-reason",
+	"x-last-death-exchange",
+	"x-last-death-queue",
+	"x-last-death-reason",
+	HeaderDecodeError,
+	HeaderExpectedType,
+	HeaderSignatureError,
+	HeaderValidationError,
+	HeaderOriginalExchange,
+	HeaderOriginalRoutingKey,
+	HeaderRetryAttempt,
+}
+
+// replayConfirmTimeout is how long a replay waits for the broker to confirm
+// it.
+const replayConfirmTimeout = 10 * time.Second
+
+// getChannel can take single messages from a queue and empty it, as
+// *amqp.Channel can.
+type getChannel interface {
+	Get(queue string, autoAck bool) (amqp.Delivery, bool, error)
+	QueuePurge(name string, noWait bool) (int, error)
+}
+
+// returnChannel hands back mandatory publishes no queue took, as
+// *amqp.Channel can.
+type returnChannel interface {
+	NotifyReturn(c chan amqp.Return) chan amqp.Return
+}
+
+// DeadLetterQueue reads a dead-letter queue without consuming from it.
+// Fetched messages stay on the queue, invisible to anyone else, until they
+// are replayed or removed; Close puts the rest back.
+type DeadLetterQueue struct {
+	ch      Channel
+	gc      getChannel
+	pub     *ConfirmPublisher
+	returns chan amqp.Return
+	queue   string
+}
+
+// OpenDeadLetterQueue opens a channel for inspecting queue.
+func OpenDeadLetterQueue(conn Subscriber, queue string) (*DeadLetterQueue, error) {
+	ch, err := conn.Channel()
+	if err != nil {
+		return nil, err
+	}
+	gc, ok := ch.(getChannel)
+	if !ok {
+		ch.Close()
+		return nil, fmt.Errorf("channel %T cannot get messages", ch)
+	}
+	rc, ok := ch.(returnChannel)
+	if !ok {
+		ch.Close()
+		return nil, fmt.Errorf("channel %T cannot return unroutable messages", ch)
+	}
+	// Returns are registered first: the broker sends a return before the
+	// confirm for the same message, so by the time a replay is confirmed
+	// its return, if any, is already buffered.
+	returns := rc.NotifyReturn(make(chan amqp.Return, 16))
+	pub, err := NewConfirmPublisher(ch, replayConfirmTimeout)
+	if err != nil {
+		ch.Close()
+		return nil, err
+	}
+	return &DeadLetterQueue{ch: ch, gc: gc, pub: pub, returns: returns, queue: queue}, nil
+}
+
+// Fetch takes up to max messages from the head of the queue, or all of
+// them if max is zero.
+func (q *DeadLetterQueue) Fetch(max int) ([]DeadLetter, error) {
+	var dls []DeadLetter
+	for max == 0 || len(dls) < max {
+		d, ok, err := q.gc.Get(q.queue, false)
+		if err != nil {
+			return dls, err
+		}
+		if !ok {
+			break
+		}
+		dls = append(dls, DeadLetterFrom(d))
+	}
+	return dls, nil
+}
+
+// Replay publishes a fetched message, without its dead-lettering headers,
+// to its ReplayTarget. Going back to the queue that dead-lettered it
+// keeps a message some other queue already handled, like another player's
+// copy of an army move, from being delivered there twice. The message is
+// only removed from the dead-letter queue once the broker has confirmed
+// the replay reached a queue.
+func (q *DeadLetterQueue) Replay(ctx context.Context, dl DeadLetter) error {
+	exchange, key := dl.ReplayTarget()
+	if exchange == "" && key == "" {
+		return errors.New("dead letter does not say where it was published")
+	}
+	pub := publishingFrom(dl.Delivery)
+	for _, h := range deadLetterHeaders {
+		delete(pub.Headers, h)
+	}
+	err := q.pub.PublishWithContext(ctx, exchange, key, true, false, pub)
+	if err != nil {
+		return err
+	}
+	if r, ok := q.returned(pub.MessageId); ok {
+		return fmt.Errorf("replay was returned: %s", r.ReplyText)
+	}
+	return dl.Delivery.Ack(false)
+}
+
+// returned reports whether the broker returned the message with id. Returns
+// left over from earlier replays are dropped.
+func (q *DeadLetterQueue) returned(id string) (amqp.Return, bool) {
+	for {
+		select {
+		case r := <-q.returns:
+			if r.MessageId == id {
+				return r, true
+			}
+		default:
+			return amqp.Return{}, false
+		}
+	}
+}
+
+// ReplayTarget is the exchange and routing key Replay publishes dl to: the
+// default exchange and the queue that dead-lettered it, if the broker did,
+// or else where it was first published.
+func (dl DeadLetter) ReplayTarget() (exchange, key string) {
+	if dl.Queue != "" {
+		return "", dl.Queue
+	}
+	return dl.Exchange, dl.RoutingKey
+}
+
+// Remove deletes a fetched message from the queue.
+func (q *DeadLetterQueue) Remove(dl DeadLetter) error {
+	return dl.Delivery.Ack(false)
+}
+
+// Purge deletes every message on the queue that hasn't been fetched.
+func (q *DeadLetterQueue) Purge() (int, error) {
+	return q.gc.QueuePurge(q.queue, false)
+}
+
+// Close returns the fetched messages that weren't replayed or removed to
+// the queue.
+func (q *DeadLetterQueue) Close() error {
+	return q.ch.Close()
+}
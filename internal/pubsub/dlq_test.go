@@ -0,0 +1,189 @@
+package pubsub
+
+import (
+	"context"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/bootdotdev/learn-pub-sub-starter/internal/routing"
+	amqp "github.com/rabbitmq/amqp091-go"
+)
+
+func TestReplayDeadLetters(t *testing.T) {
+	tests := []struct {
+		name      string
+		fail      SimpleAckType
+		reason    string
+		fromQueue string
+	}{
+		{"out of retries", NackRequeue, "retries", ""},
+		{"discarded", NackDiscard, "rejected", routing.GameLogSlug},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			b := newTestBroker(t)
+			var failing atomic.Bool
+			failing.Store(true)
+			handled := make(chan routing.GameLog, 10)
+			sub, err := Subscribe(context.Background(), b, routing.ExchangePerilTopic, routing.GameLogSlug, routing.GameLogSlug+".*", DurableQueue,
+				func(gl routing.GameLog) SimpleAckType {
+					if failing.Load() {
+						return tt.fail
+					}
+					handled <- gl
+					return Ack
+				},
+				WithRetry(RetryPolicy{Delays: []time.Duration{10 * time.Millisecond}, MaxAttempts: 2}),
+				WithDeduplication(NewLRUStore(10)),
+			)
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer sub.Close()
+			err = Publish(context.Background(), testChannel(t, b), routing.ExchangePerilTopic, "game_logs.alice", routing.GameLog{Username: "alice"})
+			if err != nil {
+				t.Fatal(err)
+			}
+			waitFor(t, "message to be dead-lettered", func() bool { return b.QueueLen(routing.DeadLetterQueue) == 1 })
+
+			dlq, err := OpenDeadLetterQueue(b, routing.DeadLetterQueue)
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer dlq.Close()
+			dls, err := dlq.Fetch(0)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if len(dls) != 1 {
+				t.Fatalf("fetched %d dead letters, want 1", len(dls))
+			}
+			dl := dls[0]
+			if dl.Reason != tt.reason || dl.Queue != tt.fromQueue {
+				t.Errorf("reason %q from queue %q, want %q from %q", dl.Reason, dl.Queue, tt.reason, tt.fromQueue)
+			}
+			if dl.Exchange != routing.ExchangePerilTopic || dl.RoutingKey != "game_logs.alice" {
+				t.Errorf("first published to %s -> %s, want %s -> game_logs.alice", dl.Exchange, dl.RoutingKey, routing.ExchangePerilTopic)
+			}
+
+			// The replay keeps its message ID, which the dedup store must not
+			// have recorded when the message failed.
+			failing.Store(false)
+			err = dlq.Replay(context.Background(), dl)
+			if err != nil {
+				t.Fatal(err)
+			}
+			select {
+			case gl := <-handled:
+				if gl.Username != "alice" {
+					t.Errorf("handled log from %s, want alice", gl.Username)
+				}
+			case <-time.After(time.Second):
+				t.Fatal("replayed message was not handled")
+			}
+		})
+	}
+}
+
+// A move one player's queue rejected goes back to that queue alone, not to
+// every player again.
+func TestReplayToRejectingQueue(t *testing.T) {
+	b := newTestBroker(t)
+	var rejecting atomic.Bool
+	rejecting.Store(true)
+	handled := map[string]chan struct{}{
+		"alice": make(chan struct{}, 10),
+		"bob":   make(chan struct{}, 10),
+	}
+	for player, ch := range handled {
+		player, ch := player, ch
+		sub, err := Subscribe(context.Background(), b, routing.ExchangePerilTopic, routing.ArmyMovesPrefix+"."+player, routing.ArmyMovesPrefix+".*", TransientQueue,
+			func(gl routing.GameLog) SimpleAckType {
+				if player == "alice" && rejecting.Load() {
+					return NackDiscard
+				}
+				ch <- struct{}{}
+				return Ack
+			},
+		)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer sub.Close()
+	}
+	err := Publish(context.Background(), testChannel(t, b), routing.ExchangePerilTopic, routing.ArmyMovesPrefix+".carol", routing.GameLog{Username: "carol"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	<-handled["bob"]
+	waitFor(t, "message to be dead-lettered", func() bool { return b.QueueLen(routing.DeadLetterQueue) == 1 })
+
+	dlq, err := OpenDeadLetterQueue(b, routing.DeadLetterQueue)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer dlq.Close()
+	dls, err := dlq.Fetch(0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(dls) != 1 {
+		t.Fatalf("fetched %d dead letters, want 1", len(dls))
+	}
+	if ex, key := dls[0].ReplayTarget(); ex != "" || key != routing.ArmyMovesPrefix+".alice" {
+		t.Errorf("replays to %q -> %q, want alice's queue", ex, key)
+	}
+	rejecting.Store(false)
+	err = dlq.Replay(context.Background(), dls[0])
+	if err != nil {
+		t.Fatal(err)
+	}
+	select {
+	case <-handled["alice"]:
+	case <-time.After(time.Second):
+		t.Fatal("alice never handled the replay")
+	}
+	select {
+	case <-handled["bob"]:
+		t.Error("bob handled the move twice")
+	case <-time.After(20 * time.Millisecond):
+	}
+}
+
+// A replay no queue takes stays on the dead-letter queue.
+func TestReplayUnroutable(t *testing.T) {
+	b := newTestBroker(t)
+	err := testChannel(t, b).PublishWithContext(context.Background(), "", routing.DeadLetterQueue, false, false, amqp.Publishing{
+		MessageId: "m1",
+		Headers: amqp.Table{"x-death": []any{amqp.Table{
+			"reason":       "rejected",
+			"queue":        "army_moves.gone",
+			"exchange":     routing.ExchangePerilTopic,
+			"routing-keys": []any{"army_moves.carol"},
+			"count":        int64(1),
+		}}},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	dlq, err := OpenDeadLetterQueue(b, routing.DeadLetterQueue)
+	if err != nil {
+		t.Fatal(err)
+	}
+	dls, err := dlq.Fetch(0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(dls) != 1 {
+		t.Fatalf("fetched %d dead letters, want 1", len(dls))
+	}
+	err = dlq.Replay(context.Background(), dls[0])
+	if err == nil {
+		t.Fatal("replay to a deleted queue succeeded")
+	}
+	dlq.Close()
+	if n := b.QueueLen(routing.DeadLetterQueue); n != 1 {
+		t.Errorf("dead-letter queue has %d messages after the failed replay, want 1", n)
+	}
+}
@@ -0,0 +1,129 @@
+package pubsub
+
+import (
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"errors"
+	"fmt"
+
+	amqp "github.com/rabbitmq/amqp091-go"
+)
+
+const (
+	HeaderEncryption    = "x-encryption"
+	HeaderEncryptionKey = "x-encryption-key"
+)
+
+const AlgAESGCM = "aes-gcm"
+
+// KeySource looks up AES keys by ID.
+type KeySource interface {
+	EncryptionKey(keyID string) ([]byte, bool)
+}
+
+type encryptedCodec struct {
+	Codec
+	keys  KeySource
+	keyID string
+}
+
+// Encrypted wraps base so that bodies are sealed with AES-GCM under the key
+// keyID, which is named in the HeaderEncryptionKey header. A key can belong
+// to one recipient or be shared by everyone on a private channel. Only
+// subscriptions given the key with WithDecryption can read the messages. To
+// compress as well, wrap the compressed codec: Encrypted(Compressed(...)).
+func Encrypted(base Codec, keys KeySource, keyID string) Codec {
+	return encryptedCodec{Codec: base, keys: keys, keyID: keyID}
+}
+
+// Marshal refuses to run: the result would not say which key to decrypt it
+// with. Encrypted codecs only work through Publish.
+func (c encryptedCodec) Marshal(v any) ([]byte, error) {
+	return nil, errors.New("encrypted codec can only be used to publish")
+}
+
+func (c encryptedCodec) encode(v any, msg *amqp.Publishing) error {
+	err := encodeInto(c.Codec, v, msg)
+	if err != nil {
+		return err
+	}
+	gcm, err := newGCM(c.keys, c.keyID)
+	if err != nil {
+		return err
+	}
+	nonce := make([]byte, gcm.NonceSize())
+	_, err = rand.Read(nonce)
+	if err != nil {
+		return err
+	}
+	msg.Body = gcm.Seal(nonce, nonce, msg.Body, encryptionAAD(c.keyID, msg.ContentType))
+	if msg.Headers == nil {
+		msg.Headers = amqp.Table{}
+	}
+	msg.Headers[HeaderEncryption] = AlgAESGCM
+	msg.Headers[HeaderEncryptionKey] = c.keyID
+	return nil
+}
+
+var ErrNotEncrypted = errors.New("message is not encrypted")
+
+// WithDecryption makes the subscription only accept messages encrypted with
+// keys from keys. Plaintext deliveries are dead-lettered, as are encrypted
+// ones whose key is unknown. Encrypted deliveries are dead-lettered by
+// subscriptions without it.
+func WithDecryption(keys KeySource) SubscribeOption {
+	return func(o *subscribeOptions) {
+		o.decryption = keys
+	}
+}
+
+// decrypt returns d's plaintext body. Deliveries that aren't encrypted are
+// returned as they are, unless required is set.
+func decrypt(keys KeySource, d amqp.Delivery, required bool) ([]byte, error) {
+	alg, ok := d.Headers[HeaderEncryption].(string)
+	if !ok {
+		if required {
+			return nil, ErrNotEncrypted
+		}
+		return d.Body, nil
+	}
+	if alg != AlgAESGCM {
+		return nil, fmt.Errorf("unknown encryption '%s'", alg)
+	}
+	keyID, _ := d.Headers[HeaderEncryptionKey].(string)
+	if keys == nil {
+		return nil, fmt.Errorf("message is encrypted with key '%s' but no keys were given", keyID)
+	}
+	gcm, err := newGCM(keys, keyID)
+	if err != nil {
+		return nil, err
+	}
+	if len(d.Body) < gcm.NonceSize() {
+		return nil, errors.New("encrypted body is too short")
+	}
+	nonce, sealed := d.Body[:gcm.NonceSize()], d.Body[gcm.NonceSize():]
+	body, err := gcm.Open(nil, nonce, sealed, encryptionAAD(keyID, d.ContentType))
+	if err != nil {
+		return nil, fmt.Errorf("decrypting with key '%s': %w", keyID, err)
+	}
+	return body, nil
+}
+
+func newGCM(keys KeySource, keyID string) (cipher.AEAD, error) {
+	key, ok := keys.EncryptionKey(keyID)
+	if !ok {
+		return nil, fmt.Errorf("unknown encryption key '%s'", keyID)
+	}
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, fmt.Errorf("encryption key '%s': %w", keyID, err)
+	}
+	return cipher.NewGCM(block)
+}
+
+// encryptionAAD binds the ciphertext to its key ID and content type, so
+// neither header can be swapped without decryption failing.
+func encryptionAAD(keyID, contentType string) []byte {
+	return []byte(keyID + "\n" + contentType)
+}
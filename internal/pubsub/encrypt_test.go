@@ -0,0 +1,77 @@
+package pubsub
+
+import (
+	"context"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/bootdotdev/learn-pub-sub-starter/internal/routing"
+)
+
+func TestDecryptionRequiresEncryption(t *testing.T) {
+	b := newTestBroker(t)
+	keys := NewKeyring()
+	err := keys.AddAES("table", make([]byte, 32))
+	if err != nil {
+		t.Fatal(err)
+	}
+	got := make(chan routing.GameLog, 1)
+	sub, err := Subscribe(context.Background(), b, routing.ExchangePerilTopic, routing.GameLogSlug, routing.GameLogSlug+".*", DurableQueue,
+		func(gl routing.GameLog) SimpleAckType {
+			got <- gl
+			return Ack
+		},
+		WithDecryption(keys),
+	)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer sub.Close()
+	pub := testChannel(t, b)
+	ctx := context.Background()
+	entry := routing.GameLog{Username: "alice", Message: strings.Repeat("a long message ", 20)}
+
+	err = Publish(ctx, pub, routing.ExchangePerilTopic, "game_logs.alice", entry)
+	if err != nil {
+		t.Fatal(err)
+	}
+	waitFor(t, "plaintext to be dead-lettered", func() bool { return b.QueueLen(routing.DeadLetterQueue) == 1 })
+	dlq, err := OpenDeadLetterQueue(b, routing.DeadLetterQueue)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer dlq.Close()
+	dls, err := dlq.Fetch(0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(dls) != 1 || dls[0].Error != ErrNotEncrypted.Error() {
+		t.Fatalf("got dead letters %+v, want one for plaintext", dls)
+	}
+
+	err = Publish(ctx, pub, routing.ExchangePerilTopic, "game_logs.alice", entry, WithCodec(Encrypted(Compressed(JSON, Gzip, 64), keys, "table")))
+	if err != nil {
+		t.Fatal(err)
+	}
+	select {
+	case gl := <-got:
+		if gl != entry {
+			t.Errorf("got %+v, want %+v", gl, entry)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("encrypted message was not handled")
+	}
+}
+
+func TestCompressedCannotWrapEncrypted(t *testing.T) {
+	keys := NewKeyring()
+	err := keys.AddAES("table", make([]byte, 32))
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = newPublishing(context.Background(), routing.GameLog{}, []PublishOption{WithCodec(Compressed(Encrypted(JSON, keys, "table"), Gzip, 0))})
+	if err == nil {
+		t.Fatal("Compressed(Encrypted(...)) encoded a message subscribers can't read")
+	}
+}
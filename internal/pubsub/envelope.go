@@ -0,0 +1,96 @@
+package pubsub
+
+import (
+	"context"
+	"crypto/rand"
+	"fmt"
+	"os"
+	"path/filepath"
+	"time"
+
+	amqp "github.com/rabbitmq/amqp091-go"
+)
+
+const HeaderSchemaVersion = "x-schema-version"
+
+const defaultSchemaVersion = 1
+
+// defaultAppID names the sender of every publish that doesn't set one.
+var defaultAppID = filepath.Base(os.Args[0])
+
+// Metadata is the envelope of a delivered message: who sent it, when, and
+// which version of its type it was encoded with.
+type Metadata struct {
+	MessageID     string
+	Timestamp     time.Time
+	AppID         string
+	Type          string
+	SchemaVersion int
+	// Exchange and RoutingKey are where the message was delivered from.
+	// For a retry that is the default exchange and the queue's name; see
+	// RetryPolicy.
+	Exchange    string
+	RoutingKey  string
+	Redelivered bool
+	// SignedBy is the key that signed the message, if the subscription
+	// verifies signatures.
+	SignedBy string
+}
+
+// Age is how long ago the message was published, or zero if the publisher
+// didn't set a timestamp.
+func (m Metadata) Age() time.Duration {
+	if m.Timestamp.IsZero() {
+		return 0
+	}
+	return time.Since(m.Timestamp)
+}
+
+type metadataKey struct{}
+
+// MetadataFromContext returns the envelope of the message a handler was
+// called with.
+func MetadataFromContext(ctx context.Context) (Metadata, bool) {
+	m, ok := ctx.Value(metadataKey{}).(Metadata)
+	return m, ok
+}
+
+func metadataFrom(d amqp.Delivery) Metadata {
+	m := Metadata{
+		MessageID:   d.MessageId,
+		Timestamp:   d.Timestamp,
+		AppID:       d.AppId,
+		Type:        d.Type,
+		Exchange:    d.Exchange,
+		RoutingKey:  d.RoutingKey,
+		Redelivered: d.Redelivered,
+	}
+	if v, ok := tableInt(d.Headers[HeaderSchemaVersion]); ok {
+		m.SchemaVersion = int(v)
+	}
+	return m
+}
+
+// WithAppID sets the publishing's AppId. The default is the executable's
+// name.
+func WithAppID(id string) PublishOption {
+	return func(o *publishOptions) {
+		o.appID = id
+	}
+}
+
+// WithSchemaVersion records which version of the message's type is being
+// published. The default is 1.
+func WithSchemaVersion(v int) PublishOption {
+	return func(o *publishOptions) {
+		o.schemaVersion = v
+	}
+}
+
+func newMessageID() string {
+	var b [16]byte
+	rand.Read(b[:])
+	b[6] = b[6]&0x0f | 0x40
+	b[8] = b[8]&0x3f | 0x80
+	return fmt.Sprintf("%x-%x-%x-%x-%x", b[0:4], b[4:6], b[6:8], b[8:10], b[10:])
+}
@@ -0,0 +1,112 @@
+package pubsub
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+	"regexp"
+	"testing"
+	"time"
+
+	"github.com/bootdotdev/learn-pub-sub-starter/internal/routing"
+	amqp "github.com/rabbitmq/amqp091-go"
+)
+
+var uuidV4 = regexp.MustCompile(`^[0-9a-f]{8}-[0-9a-f]{4}-4[0-9a-f]{3}-[89ab][0-9a-f]{3}-[0-9a-f]{12}$`)
+
+func TestNewPublishingEnvelope(t *testing.T) {
+	before := time.Now()
+	msg, err := newPublishing(context.Background(), routing.GameLog{}, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !uuidV4.MatchString(msg.MessageId) {
+		t.Errorf("message ID %q is not a random UUID", msg.MessageId)
+	}
+	if msg.Timestamp.Before(before) || msg.Timestamp.After(time.Now()) {
+		t.Errorf("timestamp %v is not the time of publishing", msg.Timestamp)
+	}
+	if want := filepath.Base(os.Args[0]); msg.AppId != want {
+		t.Errorf("app ID %q, want %q", msg.AppId, want)
+	}
+	if msg.Type != "routing.GameLog" {
+		t.Errorf("type %q, want routing.GameLog", msg.Type)
+	}
+	if v := msg.Headers[HeaderSchemaVersion]; v != int64(1) {
+		t.Errorf("schema version %v, want 1", v)
+	}
+
+	other, err := newPublishing(context.Background(), routing.GameLog{}, []PublishOption{WithAppID("peril-server"), WithSchemaVersion(2)})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if other.MessageId == msg.MessageId {
+		t.Error("two publishes got the same message ID")
+	}
+	if other.AppId != "peril-server" || other.Headers[HeaderSchemaVersion] != int64(2) {
+		t.Errorf("options ignored: app ID %q, schema version %v", other.AppId, other.Headers[HeaderSchemaVersion])
+	}
+}
+
+func TestMetadataFrom(t *testing.T) {
+	// RabbitMQ hands integer headers back in whatever width fits.
+	d := amqp.Delivery{Headers: amqp.Table{HeaderSchemaVersion: int32(3)}}
+	if m := metadataFrom(d); m.SchemaVersion != 3 {
+		t.Errorf("schema version %d, want 3", m.SchemaVersion)
+	}
+	if m := metadataFrom(amqp.Delivery{}); m.SchemaVersion != 0 || m.Age() != 0 {
+		t.Errorf("got %+v with age %v from a bare delivery", m, m.Age())
+	}
+}
+
+func TestMetadataFromContext(t *testing.T) {
+	b := newTestBroker(t)
+	got := make(chan Metadata, 1)
+	sub, err := SubscribeContext(context.Background(), b, routing.ExchangePerilTopic, routing.GameLogSlug, routing.GameLogSlug+".*", DurableQueue,
+		func(ctx context.Context, gl routing.GameLog) SimpleAckType {
+			m, ok := MetadataFromContext(ctx)
+			if !ok {
+				t.Error("handler context has no metadata")
+			}
+			got <- m
+			return Ack
+		},
+	)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer sub.Close()
+
+	var sent amqp.Publishing
+	pub := publisherFunc(func(ctx context.Context, exchange, key string, mandatory, immediate bool, msg amqp.Publishing) error {
+		sent = msg
+		return testChannel(t, b).PublishWithContext(ctx, exchange, key, mandatory, immediate, msg)
+	})
+	err = Publish(context.Background(), pub, routing.ExchangePerilTopic, "game_logs.alice", routing.GameLog{}, WithAppID("peril-client"), WithSchemaVersion(2))
+	if err != nil {
+		t.Fatal(err)
+	}
+	select {
+	case m := <-got:
+		if !m.Timestamp.Equal(sent.Timestamp) {
+			t.Errorf("timestamp %v, want %v", m.Timestamp, sent.Timestamp)
+		}
+		want := Metadata{
+			MessageID:     sent.MessageId,
+			Timestamp:     m.Timestamp,
+			AppID:         "peril-client",
+			Type:          "routing.GameLog",
+			SchemaVersion: 2,
+			Exchange:      routing.ExchangePerilTopic,
+			RoutingKey:    "game_logs.alice",
+		}
+		if m != want {
+			t.Errorf("got metadata %+v, want %+v", m, want)
+		}
+		if m.Age() <= 0 {
+			t.Errorf("age %v, want positive", m.Age())
+		}
+	case <-time.After(time.Second):
+		t.Fatal("handler never ran")
+	}
+}
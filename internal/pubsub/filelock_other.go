@@ -0,0 +1,22 @@
+//go:build !unix
+
+package pubsub
+
+import (
+	"errors"
+	"os"
+)
+
+// lockFile claims path by creating it. Unlike the unix lock, a crash leaves
+// the file behind, and it has to be removed by hand.
+func lockFile(path string) (func() error, error) {
+	f, err := os.OpenFile(path, os.O_CREATE|os.O_EXCL|os.O_WRONLY, 0644)
+	if errors.Is(err, os.ErrExist) {
+		return nil, ErrDedupStoreLocked
+	}
+	if err != nil {
+		return nil, err
+	}
+	f.Close()
+	return func() error { return os.Remove(path) }, nil
+}
@@ -0,0 +1,52 @@
+package pubsub
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/bootdotdev/learn-pub-sub-starter/internal/routing"
+	amqp "github.com/rabbitmq/amqp091-go"
+)
+
+// newTestBroker returns a memory broker with the game's exchanges and
+// dead-letter queue declared.
+func newTestBroker(t *testing.T) *MemoryBroker {
+	t.Helper()
+	b := NewMemoryBroker()
+	err := DeclareTopology(b, routing.PerilTopology())
+	if err != nil {
+		t.Fatal(err)
+	}
+	return b
+}
+
+// testChannel opens a channel on b that is closed when the test ends.
+func testChannel(t *testing.T, b *MemoryBroker) Channel {
+	t.Helper()
+	ch, err := b.Channel()
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { ch.Close() })
+	return ch
+}
+
+// publisherFunc lets a function stand in for a Publisher.
+type publisherFunc func(ctx context.Context, exchange, key string, mandatory, immediate bool, msg amqp.Publishing) error
+
+func (f publisherFunc) PublishWithContext(ctx context.Context, exchange, key string, mandatory, immediate bool, msg amqp.Publishing) error {
+	return f(ctx, exchange, key, mandatory, immediate, msg)
+}
+
+// waitFor polls cond until it holds or a second has passed.
+func waitFor(t *testing.T, what string, cond func() bool) {
+	t.Helper()
+	deadline := time.Now().Add(time.Second)
+	for !cond() {
+		if time.Now().After(deadline) {
+			t.Fatalf("timed out waiting for %s", what)
+		}
+		time.Sleep(5 * time.Millisecond)
+	}
+}
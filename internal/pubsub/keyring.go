@@ -0,0 +1,180 @@
+package pubsub
+
+import (
+	"crypto/ed25519"
+	"crypto/hmac"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"sync"
+)
+
+// Keyring holds the keys that signatures are verified against, the
+// secrets for any of them this process may sign with, and the AES keys for
+// encrypted channels.
+type Keyring struct {
+	mu      sync.RWMutex
+	hmac    map[string][]byte
+	public  map[string]ed25519.PublicKey
+	private map[string]ed25519.PrivateKey
+	aes     map[string][]byte
+}
+
+func NewKeyring() *Keyring {
+	return &Keyring{
+		hmac:    map[string][]byte{},
+		public:  map[string]ed25519.PublicKey{},
+		private: map[string]ed25519.PrivateKey{},
+		aes:     map[string][]byte{},
+	}
+}
+
+func (k *Keyring) AddHMAC(keyID string, secret []byte) {
+	k.mu.Lock()
+	defer k.mu.Unlock()
+	k.hmac[keyID] = secret
+}
+
+func (k *Keyring) AddEd25519(keyID string, pub ed25519.PublicKey, priv ed25519.PrivateKey) {
+	k.mu.Lock()
+	defer k.mu.Unlock()
+	k.public[keyID] = pub
+	if priv != nil {
+		k.private[keyID] = priv
+	}
+}
+
+// AddAES adds an AES-128, AES-192 or AES-256 key for Encrypted and
+// WithDecryption.
+func (k *Keyring) AddAES(keyID string, key []byte) error {
+	switch len(key) {
+	case 16, 24, 32:
+	default:
+		return fmt.Errorf("AES key '%s' is %d bytes, want 16, 24 or 32", keyID, len(key))
+	}
+	k.mu.Lock()
+	defer k.mu.Unlock()
+	k.aes[keyID] = key
+	return nil
+}
+
+func (k *Keyring) EncryptionKey(keyID string) ([]byte, bool) {
+	k.mu.RLock()
+	defer k.mu.RUnlock()
+	key, ok := k.aes[keyID]
+	return key, ok
+}
+
+// Signer returns a signer for keyID, if the keyring has its secret.
+func (k *Keyring) Signer(keyID string) (Signer, bool) {
+	k.mu.RLock()
+	defer k.mu.RUnlock()
+	if priv, ok := k.private[keyID]; ok {
+		return Ed25519Signer(keyID, priv), true
+	}
+	if secret, ok := k.hmac[keyID]; ok {
+		return HMACSigner(keyID, secret), true
+	}
+	return nil, false
+}
+
+func (k *Keyring) Verify(alg, keyID string, data, sig []byte) error {
+	k.mu.RLock()
+	defer k.mu.RUnlock()
+	switch alg {
+	case AlgHMACSHA256:
+		secret, ok := k.hmac[keyID]
+		if !ok {
+			return fmt.Errorf("unknown %s key '%s'", alg, keyID)
+		}
+		want, _ := HMACSigner(keyID, secret).Sign(data)
+		if !hmac.Equal(sig, want) {
+			return errors.New("bad signature")
+		}
+	case AlgEd25519:
+		pub, ok := k.public[keyID]
+		if !ok {
+			return fmt.Errorf("unknown %s key '%s'", alg, keyID)
+		}
+		if !ed25519.Verify(pub, data, sig) {
+			return errors.New("bad signature")
+		}
+	default:
+		return fmt.Errorf("unknown signature algorithm '%s'", alg)
+	}
+	return nil
+}
+
+type keyFile struct {
+	Keys []struct {
+		ID         string `json:"id"`
+		Algorithm  string `json:"alg"`
+		Secret     string `json:"secret,omitempty"`
+		PublicKey  string `json:"public_key,omitempty"`
+		PrivateKey string `json:"private_key,omitempty"`
+	} `json:"keys"`
+}
+
+// LoadKeyring reads a JSON key file:
+//
+//	{"keys": [
+//	  {"id": "server", "alg": "hmac-sha256", "secret": "<base64>"},
+//	  {"id": "alice", "alg": "ed25519", "public_key": "<base64>", "private_key": "<base64>"},
+//	  {"id": "alliance-1", "alg": "aes-gcm", "secret": "<base64 16, 24 or 32 bytes>"}
+//	]}
+//
+// Ed25519 private keys may be given as the 32-byte seed or the full 64-byte
+// key, and should only be in the key file of the player they belong to.
+func LoadKeyring(path string) (*Keyring, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	var f keyFile
+	err = json.Unmarshal(data, &f)
+	if err != nil {
+		return nil, fmt.Errorf("%s: %w", path, err)
+	}
+	k := NewKeyring()
+	for _, key := range f.Keys {
+		switch key.Algorithm {
+		case AlgHMACSHA256:
+			secret, err := base64.StdEncoding.DecodeString(key.Secret)
+			if err != nil || len(secret) == 0 {
+				return nil, fmt.Errorf("%s: key %s: bad secret", path, key.ID)
+			}
+			k.AddHMAC(key.ID, secret)
+		case AlgEd25519:
+			pub, err := base64.StdEncoding.DecodeString(key.PublicKey)
+			if err != nil || len(pub) != ed25519.PublicKeySize {
+				return nil, fmt.Errorf("%s: key %s: bad public key", path, key.ID)
+			}
+			var priv ed25519.PrivateKey
+			if key.PrivateKey != "" {
+				raw, err := base64.StdEncoding.DecodeString(key.PrivateKey)
+				switch {
+				case err == nil && len(raw) == ed25519.SeedSize:
+					priv = ed25519.NewKeyFromSeed(raw)
+				case err == nil && len(raw) == ed25519.PrivateKeySize:
+					priv = ed25519.PrivateKey(raw)
+				default:
+					return nil, fmt.Errorf("%s: key %s: bad private key", path, key.ID)
+				}
+			}
+			k.AddEd25519(key.ID, pub, priv)
+		case AlgAESGCM:
+			secret, err := base64.StdEncoding.DecodeString(key.Secret)
+			if err != nil {
+				return nil, fmt.Errorf("%s: key %s: bad secret", path, key.ID)
+			}
+			if err := k.AddAES(key.ID, secret); err != nil {
+				return nil, fmt.Errorf("%s: %w", path, err)
+			}
+		default:
+			return nil, fmt.Errorf("%s: key %s: unknown algorithm '%s'", path, key.ID, key.Algorithm)
+		}
+	}
+	return k, nil
+}
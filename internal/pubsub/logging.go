@@ -0,0 +1,51 @@
+package pubsub
+
+import (
+	"context"
+	"log/slog"
+
+	amqp "github.com/rabbitmq/amqp091-go"
+)
+
+// discardHandler drops every record. The package logs nothing unless it is
+// given a logger.
+type discardHandler struct{}
+
+func (discardHandler) Enabled(context.Context, slog.Level) bool  { return false }
+func (discardHandler) Handle(context.Context, slog.Record) error { return nil }
+func (h discardHandler) WithAttrs([]slog.Attr) slog.Handler      { return h }
+func (h discardHandler) WithGroup(string) slog.Handler           { return h }
+
+var silentLogger = slog.New(discardHandler{})
+
+// loggerProvider is implemented by connections whose logger subscriptions
+// should inherit when they aren't given one of their own.
+type loggerProvider interface {
+	logger() *slog.Logger
+}
+
+// WithConnLogger sets the logger for reconnects and for subscriptions made
+// through the Conn.
+func WithConnLogger(l *slog.Logger) ConnOption {
+	return func(c *Conn) {
+		c.log = l
+	}
+}
+
+// WithLogger sets the logger for a single subscription.
+func WithLogger(l *slog.Logger) SubscribeOption {
+	return func(o *subscribeOptions) {
+		o.logger = l
+	}
+}
+
+func deliveryAttrs(queue string, d amqp.Delivery) []any {
+	return []any{
+		slog.String("queue", queue),
+		slog.String("message_id", d.MessageId),
+		slog.String("exchange", d.Exchange),
+		slog.String("routing_key", d.RoutingKey),
+		slog.Uint64("delivery_tag", d.DeliveryTag),
+		slog.Bool("redelivered", d.Redelivered),
+	}
+}
@@ -0,0 +1,834 @@
+package pubsub
+
+import (
+	"context"
+	"fmt"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	amqp "github.com/rabbitmq/amqp091-go"
+)
+
+// MemoryBroker is an in-process stand-in for RabbitMQ. It supports the
+// default, direct, fanout and topic exchanges, acks and nacks, prefetch,
+// queue TTLs, dead-lettering, direct reply-to and basic.get, which is
+// enough to run the game flow without a server.
+type MemoryBroker struct {
+	mu        sync.Mutex
+	cond      *sync.Cond
+	exchanges map[string]*memExchange
+	queues    map[string]*memQueue
+	nextID    int
+	nextMsgID uint64
+}
+
+type memExchange struct {
+	name       string
+	kind       string
+	durable    bool
+	autoDelete bool
+	bindings   []memBinding
+}
+
+type memBinding struct {
+	queue string
+	key   string
+}
+
+type memQueue struct {
+	name       string
+	durable    bool
+	autoDelete bool
+	exclusive  bool
+	args       amqp.Table
+	messages   []memMessage
+	consumers  int
+	deleted    bool
+}
+
+type memMessage struct {
+	id          uint64
+	exchange    string
+	key         string
+	pub         amqp.Publishing
+	redelivered bool
+}
+
+type memChannel struct {
+	broker    *MemoryBroker
+	prefetch  int
+	nextTag   uint64
+	unacked   map[uint64]*memUnacked
+	consumers map[string]*memConsumer
+	exclusive []string
+	closed    bool
+	confirm   bool
+	confirmed uint64
+	confirms  []chan amqp.Confirmation
+	returns   []chan amqp.Return
+	replyTo   string
+	// notifyMu is held while confirms and returns are sent.
+	notifyMu sync.Mutex
+}
+
+type memUnacked struct {
+	queue    *memQueue
+	msg      memMessage
+	consumer *memConsumer
+}
+
+type memConsumer struct {
+	tag       string
+	ch        *memChannel
+	queue     *memQueue
+	autoAck   bool
+	inFlight  int
+	out       chan amqp.Delivery
+	done      chan struct{}
+	cancelled bool
+}
+
+func NewMemoryBroker() *MemoryBroker {
+	b := &MemoryBroker{
+		exchanges: map[string]*memExchange{
+			"": {name: "", kind: amqp.ExchangeDirect},
+		},
+		queues: map[string]*memQueue{},
+	}
+	b.cond = sync.NewCond(&b.mu)
+	return b
+}
+
+func (b *MemoryBroker) Channel() (Channel, error) {
+	return &memChannel{
+		broker:    b,
+		unacked:   map[uint64]*memUnacked{},
+		consumers: map[string]*memConsumer{},
+	}, nil
+}
+
+// QueueLen reports how many ready (undelivered) messages a queue holds.
+func (b *MemoryBroker) QueueLen(name string) int {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	q, ok := b.queues[name]
+	if !ok {
+		return 0
+	}
+	return len(q.messages)
+}
+
+func (b *MemoryBroker) genName(prefix string) string {
+	b.nextID++
+	return fmt.Sprintf("%s-%d", prefix, b.nextID)
+}
+
+// route enqueues pub on every queue it routes to and reports whether there
+// were any. It must be called with b.mu held.
+func (b *MemoryBroker) route(exchange, key string, pub amqp.Publishing) (bool, error) {
+	ex, ok := b.exchanges[exchange]
+	if !ok {
+		return false, fmt.Errorf("no exchange '%s' in memory broker", exchange)
+	}
+	var targets []string
+	if ex.name == "" {
+		targets = append(targets, key)
+	}
+	for _, bnd := range ex.bindings {
+		if bindingMatches(ex.kind, bnd.key, key) {
+			targets = append(targets, bnd.queue)
+		}
+	}
+	routed := false
+	seen := map[string]bool{}
+	for _, name := range targets {
+		if seen[name] {
+			continue
+		}
+		seen[name] = true
+		q, ok := b.queues[name]
+		if !ok {
+			continue
+		}
+		b.enqueue(q, memMessage{exchange: exchange, key: key, pub: pub})
+		routed = true
+	}
+	return routed, nil
+}
+
+// enqueue must be called with b.mu held.
+func (b *MemoryBroker) enqueue(q *memQueue, msg memMessage) {
+	b.nextMsgID++
+	msg.id = b.nextMsgID
+	q.messages = append(q.messages, msg)
+	if ttl, ok := tableInt(q.args["x-message-ttl"]); ok {
+		time.AfterFunc(time.Duration(ttl)*time.Millisecond, func() {
+			b.expire(q, msg.id)
+		})
+	}
+	b.cond.Broadcast()
+}
+
+// expire dead-letters a message whose queue TTL has passed, unless it has
+// already been delivered.
+func (b *MemoryBroker) expire(q *memQueue, id uint64) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	for i, msg := range q.messages {
+		if msg.id == id {
+			q.messages = append(q.messages[:i:i], q.messages[i+1:]...)
+			b.deadLetter(q, msg, "expired")
+			return
+		}
+	}
+}
+
+// requeue puts a message back at the head of its queue. b.mu must be held.
+func (b *MemoryBroker) requeue(q *memQueue, msg memMessage, redelivered bool) {
+	if q.deleted {
+		return
+	}
+	msg.redelivered = msg.redelivered || redelivered
+	q.messages = append([]memMessage{msg}, q.messages...)
+	b.cond.Broadcast()
+}
+
+// deadLetter republishes a rejected message to the queue's
+// x-dead-letter-exchange, if it has one. b.mu must be held.
+func (b *MemoryBroker) deadLetter(q *memQueue, msg memMessage, reason string) {
+	dlx, ok := q.args["x-dead-letter-exchange"].(string)
+	if !ok {
+		return
+	}
+	key := msg.key
+	if k, ok := q.args["x-dead-letter-routing-key"].(string); ok {
+		key = k
+	}
+	pub := msg.pub
+	pub.Headers = amqp.Table{}
+	for k, v := range msg.pub.Headers {
+		pub.Headers[k] = v
+	}
+	pub.Headers["x-death"] = addDeath(msg.pub.Headers["x-death"], q.name, reason, msg.exchange, msg.key)
+	b.route(dlx, key, pub)
+}
+
+func addDeath(existing any, queue, reason, exchange, key string) []any {
+	deaths, _ := existing.([]any)
+	out := []any{}
+	count := int64(1)
+	for _, d := range deaths {
+		t, ok := d.(amqp.Table)
+		if ok && t["queue"] == queue && t["reason"] == reason {
+			if c, ok := t["count"].(int64); ok {
+				count = c + 1
+			}
+			continue
+		}
+		out = append(out, d)
+	}
+	entry := amqp.Table{
+		"count":        count,
+		"reason":       reason,
+		"queue":        queue,
+		"time":         time.Now(),
+		"exchange":     exchange,
+		"routing-keys": []any{key},
+	}
+	return append([]any{entry}, out...)
+}
+
+// deleteQueue must be called with b.mu held.
+func (b *MemoryBroker) deleteQueue(q *memQueue) {
+	q.deleted = true
+	q.messages = nil
+	delete(b.queues, q.name)
+	for _, ex := range b.exchanges {
+		kept := ex.bindings[:0]
+		for _, bnd := range ex.bindings {
+			if bnd.queue != q.name {
+				kept = append(kept, bnd)
+			}
+		}
+		ex.bindings = kept
+	}
+	b.cond.Broadcast()
+}
+
+func bindingMatches(kind, pattern, key string) bool {
+	switch kind {
+	case amqp.ExchangeFanout:
+		return true
+	case amqp.ExchangeTopic:
+		return topicMatch(pattern, key)
+	default:
+		return pattern == key
+	}
+}
+
+func topicMatch(pattern, key string) bool {
+	return matchWords(topicWords(pattern), topicWords(key))
+}
+
+// topicWords splits a key into words. Like RabbitMQ, it treats the empty key
+// as no words rather than one empty word.
+func topicWords(key string) []string {
+	if key == "" {
+		return nil
+	}
+	return strings.Split(key, ".")
+}
+
+func matchWords(pattern, words []string) bool {
+	if len(pattern) == 0 {
+		return len(words) == 0
+	}
+	switch pattern[0] {
+	case "#":
+		for i := 0; i <= len(words); i++ {
+			if matchWords(pattern[1:], words[i:]) {
+				return true
+			}
+		}
+		return false
+	case "*":
+		return len(words) > 0 && matchWords(pattern[1:], words[1:])
+	default:
+		return len(words) > 0 && pattern[0] == words[0] && matchWords(pattern[1:], words[1:])
+	}
+}
+
+func (ch *memChannel) PublishWithContext(ctx context.Context, exchange, key string, mandatory, immediate bool, msg amqp.Publishing) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+	b := ch.broker
+	b.mu.Lock()
+	if ch.closed {
+		b.mu.Unlock()
+		return amqp.ErrClosed
+	}
+	if msg.ReplyTo == DirectReplyTo {
+		if ch.replyTo == "" {
+			b.mu.Unlock()
+			return fmt.Errorf("no consumer on %s for this channel", DirectReplyTo)
+		}
+		msg.ReplyTo = ch.replyTo
+	}
+	routed, err := b.route(exchange, key, msg)
+	if err != nil {
+		b.mu.Unlock()
+		return err
+	}
+	var returns []chan amqp.Return
+	if mandatory && !routed {
+		returns = ch.returns
+	}
+	var confirms []chan amqp.Confirmation
+	var tag uint64
+	if ch.confirm {
+		ch.confirmed++
+		confirms, tag = ch.confirms, ch.confirmed
+	}
+	// Listeners are notified without b.mu held, so they can use the broker
+	// themselves. notifyMu is taken first so that notifications go out in
+	// publish order and Close can't close a listener mid-send.
+	ch.notifyMu.Lock()
+	defer ch.notifyMu.Unlock()
+	b.mu.Unlock()
+	if len(returns) > 0 {
+		ret := amqp.Return{
+			ReplyCode:       amqp.NoRoute,
+			ReplyText:       "NO_ROUTE",
+			Exchange:        exchange,
+			RoutingKey:      key,
+			ContentType:     msg.ContentType,
+			ContentEncoding: msg.ContentEncoding,
+			Headers:         msg.Headers,
+			MessageId:       msg.MessageId,
+			Body:            msg.Body,
+		}
+		for _, c := range returns {
+			c <- ret
+		}
+	}
+	for _, c := range confirms {
+		c <- amqp.Confirmation{DeliveryTag: tag, Ack: true}
+	}
+	return nil
+}
+
+func (ch *memChannel) Confirm(noWait bool) error {
+	b := ch.broker
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if ch.closed {
+		return amqp.ErrClosed
+	}
+	ch.confirm = true
+	return nil
+}
+
+func (ch *memChannel) NotifyPublish(confirm chan amqp.Confirmation) chan amqp.Confirmation {
+	b := ch.broker
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if ch.closed {
+		close(confirm)
+		return confirm
+	}
+	ch.confirms = append(ch.confirms, confirm)
+	return confirm
+}
+
+// NotifyReturn registers a listener for mandatory publishes that no queue
+// took.
+func (ch *memChannel) NotifyReturn(c chan amqp.Return) chan amqp.Return {
+	b := ch.broker
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if ch.closed {
+		close(c)
+		return c
+	}
+	ch.returns = append(ch.returns, c)
+	return c
+}
+
+func (ch *memChannel) ExchangeDeclare(name, kind string, durable, autoDelete, internal, noWait bool, args amqp.Table) error {
+	b := ch.broker
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if ch.closed {
+		return amqp.ErrClosed
+	}
+	if ex, ok := b.exchanges[name]; ok {
+		if ex.kind != kind || ex.durable != durable || ex.autoDelete != autoDelete {
+			return preconditionFailed("exchange '%s' already declared as %s, durable %v, auto-delete %v", name, ex.kind, ex.durable, ex.autoDelete)
+		}
+		return nil
+	}
+	switch kind {
+	case amqp.ExchangeDirect, amqp.ExchangeFanout, amqp.ExchangeTopic:
+	default:
+		return fmt.Errorf("unsupported exchange kind '%s'", kind)
+	}
+	b.exchanges[name] = &memExchange{name: name, kind: kind, durable: durable, autoDelete: autoDelete}
+	return nil
+}
+
+func (ch *memChannel) QueueDeclare(name string, durable, autoDelete, exclusive, noWait bool, args amqp.Table) (amqp.Queue, error) {
+	b := ch.broker
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if ch.closed {
+		return amqp.Queue{}, amqp.ErrClosed
+	}
+	if name == "" {
+		name = b.genName("amq.gen")
+	}
+	q, ok := b.queues[name]
+	if !ok {
+		q = &memQueue{
+			name:       name,
+			durable:    durable,
+			autoDelete: autoDelete,
+			exclusive:  exclusive,
+			args:       args,
+		}
+		b.queues[name] = q
+		if exclusive {
+			ch.exclusive = append(ch.exclusive, name)
+		}
+	} else if q.durable != durable || q.autoDelete != autoDelete || !argsEqual(q.args, args) {
+		return amqp.Queue{}, preconditionFailed("queue '%s' already declared with durable %v, auto-delete %v, arguments %v", name, q.durable, q.autoDelete, q.args)
+	}
+	return amqp.Queue{Name: q.name, Messages: len(q.messages), Consumers: q.consumers}, nil
+}
+
+// preconditionFailed is the error RabbitMQ gives for redeclaring something
+// with different settings.
+func preconditionFailed(format string, args ...any) error {
+	return &amqp.Error{Code: amqp.PreconditionFailed, Reason: "PRECONDITION_FAILED - " + fmt.Sprintf(format, args...)}
+}
+
+// argsEqual compares declaration arguments, treating every integer type as
+// the same.
+func argsEqual(a, b amqp.Table) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	for k, av := range a {
+		bv, ok := b[k]
+		if !ok {
+			return false
+		}
+		an, aInt := tableInt(av)
+		bn, bInt := tableInt(bv)
+		if aInt || bInt {
+			if an != bn || aInt != bInt {
+				return false
+			}
+			continue
+		}
+		if fmt.Sprint(av) != fmt.Sprint(bv) {
+			return false
+		}
+	}
+	return true
+}
+
+func (ch *memChannel) ExchangeDeclarePassive(name, kind string, durable, autoDelete, internal, noWait bool, args amqp.Table) error {
+	b := ch.broker
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if ch.closed {
+		return amqp.ErrClosed
+	}
+	if _, ok := b.exchanges[name]; !ok {
+		return &amqp.Error{Code: amqp.NotFound, Reason: fmt.Sprintf("NOT_FOUND - no exchange '%s'", name)}
+	}
+	return nil
+}
+
+func (ch *memChannel) QueueDeclarePassive(name string, durable, autoDelete, exclusive, noWait bool, args amqp.Table) (amqp.Queue, error) {
+	b := ch.broker
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if ch.closed {
+		return amqp.Queue{}, amqp.ErrClosed
+	}
+	q, ok := b.queues[name]
+	if !ok {
+		return amqp.Queue{}, &amqp.Error{Code: amqp.NotFound, Reason: fmt.Sprintf("NOT_FOUND - no queue '%s'", name)}
+	}
+	return amqp.Queue{Name: q.name, Messages: len(q.messages), Consumers: q.consumers}, nil
+}
+
+func (ch *memChannel) QueueBind(name, key, exchange string, noWait bool, args amqp.Table) error {
+	b := ch.broker
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if ch.closed {
+		return amqp.ErrClosed
+	}
+	ex, ok := b.exchanges[exchange]
+	if !ok || exchange == "" {
+		return fmt.Errorf("no exchange '%s' in memory broker", exchange)
+	}
+	if _, ok := b.queues[name]; !ok {
+		return fmt.Errorf("no queue '%s' in memory broker", name)
+	}
+	for _, bnd := range ex.bindings {
+		if bnd.queue == name && bnd.key == key {
+			return nil
+		}
+	}
+	ex.bindings = append(ex.bindings, memBinding{queue: name, key: key})
+	return nil
+}
+
+func (ch *memChannel) Qos(prefetchCount, prefetchSize int, global bool) error {
+	b := ch.broker
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if ch.closed {
+		return amqp.ErrClosed
+	}
+	ch.prefetch = prefetchCount
+	b.cond.Broadcast()
+	return nil
+}
+
+func (ch *memChannel) Consume(queue, consumer string, autoAck, exclusive, noLocal, noWait bool, args amqp.Table) (<-chan amqp.Delivery, error) {
+	b := ch.broker
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if ch.closed {
+		return nil, amqp.ErrClosed
+	}
+	if queue == DirectReplyTo {
+		// Direct reply-to is backed by a private queue named after the
+		// channel, which is what requests published here carry as ReplyTo.
+		if !autoAck {
+			return nil, fmt.Errorf("%s requires auto-ack", DirectReplyTo)
+		}
+		if ch.replyTo != "" {
+			return nil, fmt.Errorf("channel already consumes from %s", DirectReplyTo)
+		}
+		ch.replyTo = b.genName(DirectReplyTo)
+		b.queues[ch.replyTo] = &memQueue{name: ch.replyTo, exclusive: true, autoDelete: true}
+		ch.exclusive = append(ch.exclusive, ch.replyTo)
+		queue = ch.replyTo
+	}
+	q, ok := b.queues[queue]
+	if !ok {
+		return nil, fmt.Errorf("no queue '%s' in memory broker", queue)
+	}
+	if consumer == "" {
+		consumer = b.genName("ctag")
+	}
+	if _, ok := ch.consumers[consumer]; ok {
+		return nil, fmt.Errorf("consumer tag '%s' already in use", consumer)
+	}
+	c := &memConsumer{
+		tag:     consumer,
+		ch:      ch,
+		queue:   q,
+		autoAck: autoAck,
+		out:     make(chan amqp.Delivery),
+		done:    make(chan struct{}),
+	}
+	ch.consumers[consumer] = c
+	q.consumers++
+	go c.run()
+	return c.out, nil
+}
+
+// Get takes the message at the head of a queue, if there is one.
+func (ch *memChannel) Get(queue string, autoAck bool) (amqp.Delivery, bool, error) {
+	b := ch.broker
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if ch.closed {
+		return amqp.Delivery{}, false, amqp.ErrClosed
+	}
+	q, ok := b.queues[queue]
+	if !ok {
+		return amqp.Delivery{}, false, fmt.Errorf("no queue '%s' in memory broker", queue)
+	}
+	if len(q.messages) == 0 {
+		return amqp.Delivery{}, false, nil
+	}
+	msg := q.messages[0]
+	q.messages = q.messages[1:]
+	ch.nextTag++
+	if !autoAck {
+		ch.unacked[ch.nextTag] = &memUnacked{queue: q, msg: msg}
+	}
+	return ch.delivery(msg, ch.nextTag), true, nil
+}
+
+// QueuePurge drops a queue's ready messages and returns how many there were.
+func (ch *memChannel) QueuePurge(name string, noWait bool) (int, error) {
+	b := ch.broker
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if ch.closed {
+		return 0, amqp.ErrClosed
+	}
+	q, ok := b.queues[name]
+	if !ok {
+		return 0, fmt.Errorf("no queue '%s' in memory broker", name)
+	}
+	n := len(q.messages)
+	q.messages = nil
+	return n, nil
+}
+
+func (ch *memChannel) Cancel(consumer string, noWait bool) error {
+	b := ch.broker
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if ch.closed {
+		return amqp.ErrClosed
+	}
+	c, ok := ch.consumers[consumer]
+	if !ok {
+		return fmt.Errorf("unknown consumer tag '%s'", consumer)
+	}
+	ch.cancel(c)
+	return nil
+}
+
+func (ch *memChannel) Close() error {
+	b := ch.broker
+	b.mu.Lock()
+	if ch.closed {
+		b.mu.Unlock()
+		return nil
+	}
+	ch.closed = true
+	for _, c := range ch.consumers {
+		ch.cancel(c)
+	}
+	confirms, returns := ch.confirms, ch.returns
+	ch.confirms, ch.returns = nil, nil
+	tags := make([]uint64, 0, len(ch.unacked))
+	for tag := range ch.unacked {
+		tags = append(tags, tag)
+	}
+	sort.Slice(tags, func(i, j int) bool { return tags[i] > tags[j] })
+	for _, tag := range tags {
+		u := ch.unacked[tag]
+		b.requeue(u.queue, u.msg, true)
+	}
+	ch.unacked = map[uint64]*memUnacked{}
+	for _, name := range ch.exclusive {
+		if q, ok := b.queues[name]; ok {
+			b.deleteQueue(q)
+		}
+	}
+	b.cond.Broadcast()
+	b.mu.Unlock()
+
+	// Publishes still notifying listeners hold notifyMu; none start once
+	// the channel is marked closed.
+	ch.notifyMu.Lock()
+	defer ch.notifyMu.Unlock()
+	for _, c := range confirms {
+		close(c)
+	}
+	for _, c := range returns {
+		close(c)
+	}
+	return nil
+}
+
+// cancel must be called with b.mu held.
+func (ch *memChannel) cancel(c *memConsumer) {
+	if c.cancelled {
+		return
+	}
+	c.cancelled = true
+	close(c.done)
+	delete(ch.consumers, c.tag)
+	c.queue.consumers--
+	if c.queue.autoDelete && c.queue.consumers == 0 && !c.queue.deleted {
+		ch.broker.deleteQueue(c.queue)
+	}
+	ch.broker.cond.Broadcast()
+}
+
+func (ch *memChannel) Ack(tag uint64, multiple bool) error {
+	return ch.settle(tag, multiple, func(u *memUnacked) {})
+}
+
+func (ch *memChannel) Nack(tag uint64, multiple bool, requeue bool) error {
+	return ch.settle(tag, multiple, func(u *memUnacked) {
+		if requeue {
+			ch.broker.requeue(u.queue, u.msg, true)
+			return
+		}
+		ch.broker.deadLetter(u.queue, u.msg, "rejected")
+	})
+}
+
+func (ch *memChannel) Reject(tag uint64, requeue bool) error {
+	return ch.Nack(tag, false, requeue)
+}
+
+func (ch *memChannel) settle(tag uint64, multiple bool, fn func(*memUnacked)) error {
+	b := ch.broker
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if ch.closed {
+		return amqp.ErrClosed
+	}
+	tags := []uint64{}
+	if multiple {
+		for t := range ch.unacked {
+			if t <= tag {
+				tags = append(tags, t)
+			}
+		}
+		sort.Slice(tags, func(i, j int) bool { return tags[i] < tags[j] })
+	} else {
+		if _, ok := ch.unacked[tag]; !ok {
+			return fmt.Errorf("unknown delivery tag %d", tag)
+		}
+		tags = append(tags, tag)
+	}
+	for _, t := range tags {
+		u := ch.unacked[t]
+		delete(ch.unacked, t)
+		if u.consumer != nil {
+			u.consumer.inFlight--
+		}
+		fn(u)
+	}
+	b.cond.Broadcast()
+	return nil
+}
+
+// ready must be called with b.mu held.
+func (c *memConsumer) ready() bool {
+	if len(c.queue.messages) == 0 {
+		return false
+	}
+	return c.autoAck || c.ch.prefetch == 0 || c.inFlight < c.ch.prefetch
+}
+
+func (c *memConsumer) run() {
+	defer close(c.out)
+	b := c.ch.broker
+	for {
+		b.mu.Lock()
+		for !c.cancelled && !c.ready() {
+			b.cond.Wait()
+		}
+		if c.cancelled {
+			b.mu.Unlock()
+			return
+		}
+		msg := c.queue.messages[0]
+		c.queue.messages = c.queue.messages[1:]
+		d := c.delivery(msg)
+		b.mu.Unlock()
+
+		select {
+		case c.out <- d:
+		case <-c.done:
+			b.mu.Lock()
+			if c.autoAck {
+				b.requeue(c.queue, msg, false)
+			} else if _, ok := c.ch.unacked[d.DeliveryTag]; ok {
+				delete(c.ch.unacked, d.DeliveryTag)
+				c.inFlight--
+				b.requeue(c.queue, msg, false)
+			}
+			b.mu.Unlock()
+			return
+		}
+	}
+}
+
+// delivery must be called with b.mu held.
+func (c *memConsumer) delivery(msg memMessage) amqp.Delivery {
+	c.ch.nextTag++
+	tag := c.ch.nextTag
+	if !c.autoAck {
+		c.inFlight++
+		c.ch.unacked[tag] = &memUnacked{queue: c.queue, msg: msg, consumer: c}
+	}
+	d := c.ch.delivery(msg, tag)
+	d.ConsumerTag = c.tag
+	return d
+}
+
+func (ch *memChannel) delivery(msg memMessage, tag uint64) amqp.Delivery {
+	p := msg.pub
+	return amqp.Delivery{
+		Acknowledger:    ch,
+		Headers:         p.Headers,
+		ContentType:     p.ContentType,
+		ContentEncoding: p.ContentEncoding,
+		DeliveryMode:    p.DeliveryMode,
+		Priority:        p.Priority,
+		CorrelationId:   p.CorrelationId,
+		ReplyTo:         p.ReplyTo,
+		Expiration:      p.Expiration,
+		MessageId:       p.MessageId,
+		Timestamp:       p.Timestamp,
+		Type:            p.Type,
+		UserId:          p.UserId,
+		AppId:           p.AppId,
+		DeliveryTag:     tag,
+		Redelivered:     msg.redelivered,
+		Exchange:        msg.exchange,
+		RoutingKey:      msg.key,
+		Body:            p.Body,
+	}
+}
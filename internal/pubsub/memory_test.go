@@ -0,0 +1,253 @@
+package pubsub
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	amqp "github.com/rabbitmq/amqp091-go"
+)
+
+func TestTopicMatch(t *testing.T) {
+	tests := []struct {
+		pattern string
+		key     string
+		want    bool
+	}{
+		{"army_moves.alice", "army_moves.alice", true},
+		{"army_moves.alice", "army_moves.bob", false},
+		{"army_moves.*", "army_moves.alice", true},
+		{"army_moves.*", "army_moves", false},
+		{"army_moves.*", "army_moves.alice.extra", false},
+		{"*.alice", "war.alice", true},
+		{"*.*", "war", false},
+		{"#", "", true},
+		{"#", "war.alice.bob", true},
+		{"war.#", "war", true},
+		{"war.#", "war.alice.bob", true},
+		{"war.#", "army_moves.alice", false},
+		{"#.bob", "war.alice.bob", true},
+		{"war.#.bob", "war.bob", true},
+		{"war.#.bob", "war.alice.carol.bob", true},
+		{"war.#.bob", "war.alice", false},
+		{"#.*", "war", true},
+		{"#.*", "", false},
+		{"*", "", false},
+		{"", "", true},
+		{"", "war", false},
+	}
+	for _, tt := range tests {
+		if got := topicMatch(tt.pattern, tt.key); got != tt.want {
+			t.Errorf("topicMatch(%q, %q) = %v, want %v", tt.pattern, tt.key, got, tt.want)
+		}
+	}
+}
+
+func TestBindingMatches(t *testing.T) {
+	tests := []struct {
+		kind    string
+		pattern string
+		key     string
+		want    bool
+	}{
+		{amqp.ExchangeDirect, "pause", "pause", true},
+		{amqp.ExchangeDirect, "pause", "pause_state", false},
+		{amqp.ExchangeDirect, "*", "pause", false},
+		{amqp.ExchangeFanout, "", "anything", true},
+		{amqp.ExchangeTopic, "game_logs.*", "game_logs.alice", true},
+	}
+	for _, tt := range tests {
+		if got := bindingMatches(tt.kind, tt.pattern, tt.key); got != tt.want {
+			t.Errorf("bindingMatches(%s, %q, %q) = %v, want %v", tt.kind, tt.pattern, tt.key, got, tt.want)
+		}
+	}
+}
+
+// newWorkQueue declares a queue "work" that dead-letters to the queue
+// "dead", and returns a channel consuming from it.
+func newWorkQueue(t *testing.T, args amqp.Table) (*MemoryBroker, Channel, <-chan amqp.Delivery) {
+	t.Helper()
+	b := NewMemoryBroker()
+	ch := testChannel(t, b)
+	must := func(err error) {
+		t.Helper()
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	must(ch.ExchangeDeclare("dlx", amqp.ExchangeFanout, true, false, false, false, nil))
+	_, err := ch.QueueDeclare("dead", true, false, false, false, nil)
+	must(err)
+	must(ch.QueueBind("dead", "", "dlx", false, nil))
+	queueArgs := amqp.Table{"x-dead-letter-exchange": "dlx"}
+	for k, v := range args {
+		queueArgs[k] = v
+	}
+	_, err = ch.QueueDeclare("work", true, false, false, false, queueArgs)
+	must(err)
+	msgs, err := ch.Consume("work", "", false, false, false, false, nil)
+	must(err)
+	return b, ch, msgs
+}
+
+func publishWork(t *testing.T, b *MemoryBroker, body string) {
+	t.Helper()
+	err := testChannel(t, b).PublishWithContext(context.Background(), "", "work", false, false, amqp.Publishing{Body: []byte(body)})
+	if err != nil {
+		t.Fatal(err)
+	}
+}
+
+func next(t *testing.T, msgs <-chan amqp.Delivery) amqp.Delivery {
+	t.Helper()
+	select {
+	case d := <-msgs:
+		return d
+	case <-time.After(time.Second):
+		t.Fatal("no delivery")
+		return amqp.Delivery{}
+	}
+}
+
+func deaths(d amqp.Delivery) []any {
+	xd, _ := d.Headers["x-death"].([]any)
+	return xd
+}
+
+func TestMemoryAckNack(t *testing.T) {
+	tests := []struct {
+		name       string
+		settle     func(d amqp.Delivery) error
+		redeliver  bool
+		deadReason string
+	}{
+		{"ack", func(d amqp.Delivery) error { return d.Ack(false) }, false, ""},
+		{"nack requeue", func(d amqp.Delivery) error { return d.Nack(false, true) }, true, ""},
+		{"nack discard", func(d amqp.Delivery) error { return d.Nack(false, false) }, false, "rejected"},
+		{"reject", func(d amqp.Delivery) error { return d.Reject(false) }, false, "rejected"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			b, _, msgs := newWorkQueue(t, nil)
+			publishWork(t, b, "job")
+			d := next(t, msgs)
+			if d.Redelivered {
+				t.Error("first delivery marked redelivered")
+			}
+			if err := tt.settle(d); err != nil {
+				t.Fatal(err)
+			}
+			if tt.redeliver {
+				if again := next(t, msgs); !again.Redelivered || string(again.Body) != "job" {
+					t.Errorf("requeued delivery is %q, redelivered %v", again.Body, again.Redelivered)
+				}
+			}
+			if tt.deadReason == "" {
+				if n := b.QueueLen("dead"); n != 0 {
+					t.Errorf("%d messages dead-lettered, want none", n)
+				}
+				return
+			}
+			dl, ok, err := testChannel(t, b).(getChannel).Get("dead", true)
+			if err != nil || !ok {
+				t.Fatalf("no dead letter: %v", err)
+			}
+			xd := deaths(dl)
+			if len(xd) != 1 || xd[0].(amqp.Table)["reason"] != tt.deadReason || xd[0].(amqp.Table)["queue"] != "work" {
+				t.Errorf("x-death is %v, want one %s death from work", xd, tt.deadReason)
+			}
+		})
+	}
+}
+
+func TestMemoryTTLDeadLetters(t *testing.T) {
+	b := NewMemoryBroker()
+	ch := testChannel(t, b)
+	ch.ExchangeDeclare("dlx", amqp.ExchangeFanout, true, false, false, false, nil)
+	ch.QueueDeclare("dead", true, false, false, false, nil)
+	ch.QueueBind("dead", "", "dlx", false, nil)
+	_, err := ch.QueueDeclare("work", true, false, false, false, amqp.Table{"x-dead-letter-exchange": "dlx", "x-message-ttl": int64(10)})
+	if err != nil {
+		t.Fatal(err)
+	}
+	publishWork(t, b, "job")
+	waitFor(t, "message to expire", func() bool { return b.QueueLen("dead") == 1 })
+	if n := b.QueueLen("work"); n != 0 {
+		t.Errorf("%d messages left on work", n)
+	}
+}
+
+func TestMemoryCloseRequeuesUnacked(t *testing.T) {
+	b, ch, msgs := newWorkQueue(t, nil)
+	publishWork(t, b, "job")
+	next(t, msgs)
+	if err := ch.Close(); err != nil {
+		t.Fatal(err)
+	}
+	if n := b.QueueLen("work"); n != 1 {
+		t.Errorf("%d messages on work after closing, want the unacked one back", n)
+	}
+}
+
+func TestMemoryPrefetch(t *testing.T) {
+	b, ch, msgs := newWorkQueue(t, nil)
+	// Consuming has started, so the new limit applies from the next delivery.
+	if err := ch.Qos(1, 0, false); err != nil {
+		t.Fatal(err)
+	}
+	publishWork(t, b, "one")
+	first := next(t, msgs)
+	publishWork(t, b, "two")
+	select {
+	case d := <-msgs:
+		t.Fatalf("got %q past the prefetch limit", d.Body)
+	case <-time.After(20 * time.Millisecond):
+	}
+	first.Ack(false)
+	if d := next(t, msgs); string(d.Body) != "two" {
+		t.Errorf("got %q, want two", d.Body)
+	}
+}
+
+func TestMemoryRejectsBindingToDefaultExchange(t *testing.T) {
+	b := NewMemoryBroker()
+	ch := testChannel(t, b)
+	ch.QueueDeclare("work", true, false, false, false, nil)
+	if err := ch.QueueBind("work", "work", "", false, nil); err == nil {
+		t.Error("bound a queue to the default exchange")
+	}
+}
+
+func TestMemoryConfirmListenerCanPublish(t *testing.T) {
+	b := NewMemoryBroker()
+	ch := testChannel(t, b)
+	other := testChannel(t, b)
+	if err := ch.Confirm(false); err != nil {
+		t.Fatal(err)
+	}
+	confirms := ch.NotifyPublish(make(chan amqp.Confirmation))
+	ctx := context.Background()
+
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		for range 2 {
+			<-confirms
+			// A listener that talks to the broker must not block the
+			// publish that is waiting to hand it the next confirm.
+			other.PublishWithContext(ctx, "", "nowhere", false, false, amqp.Publishing{})
+		}
+	}()
+	go func() {
+		for range 2 {
+			if err := ch.PublishWithContext(ctx, "", "nowhere", false, false, amqp.Publishing{}); err != nil {
+				t.Error(err)
+			}
+		}
+	}()
+	select {
+	case <-done:
+	case <-time.After(time.Second):
+		t.Fatal("publish deadlocked with the confirm listener")
+	}
+}
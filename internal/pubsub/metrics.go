@@ -0,0 +1,209 @@
+package pubsub
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"net/http"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	amqp "github.com/rabbitmq/amqp091-go"
+)
+
+const (
+	metricPublished        = "peril_messages_published_total"
+	metricAcked            = "peril_messages_acked_total"
+	metricNackedRequeue    = "peril_messages_nacked_requeue_total"
+	metricNackedDiscard    = "peril_messages_nacked_discard_total"
+	metricDecodeErrors     = "peril_decode_errors_total"
+	metricSignatureErrors  = "peril_signature_errors_total"
+	metricValidationErrors = "peril_validation_errors_total"
+	metricHandlerTime      = "peril_handler_duration_seconds"
+)
+
+var metricFamilies = []struct {
+	name string
+	kind string
+	help string
+}{
+	{metricPublished, "counter", "Messages published."},
+	{metricAcked, "counter", "Deliveries acked after handling."},
+	{metricNackedRequeue, "counter", "Deliveries nacked for redelivery or retry."},
+	{metricNackedDiscard, "counter", "Deliveries nacked without requeue."},
+	{metricDecodeErrors, "counter", "Deliveries that could not be decoded."},
+	{metricSignatureErrors, "counter", "Deliveries rejected for a missing or bad signature."},
+	{metricValidationErrors, "counter", "Deliveries rejected by schema or message validation."},
+	{metricHandlerTime, "histogram", "Time spent in subscription handlers."},
+}
+
+var handlerBuckets = []float64{0.001, 0.005, 0.01, 0.05, 0.1, 0.5, 1, 2.5, 5, 10}
+
+// Metrics counts messages flowing through publishers and subscriptions and
+// serves them in the Prometheus text format.
+type Metrics struct {
+	mu         sync.Mutex
+	counters   map[string]map[metricLabels]float64
+	histograms map[string]map[metricLabels]*histogram
+}
+
+type metricLabels struct {
+	exchange string
+	queue    string
+	typ      string
+}
+
+type histogram struct {
+	counts []uint64
+	sum    float64
+	count  uint64
+}
+
+func NewMetrics() *Metrics {
+	return &Metrics{
+		counters:   map[string]map[metricLabels]float64{},
+		histograms: map[string]map[metricLabels]*histogram{},
+	}
+}
+
+// WithMetrics records the subscription's outcomes and handler latency.
+func WithMetrics(m *Metrics) SubscribeOption {
+	return func(o *subscribeOptions) {
+		o.metrics = m
+	}
+}
+
+func (m *Metrics) inc(name string, l metricLabels) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	series, ok := m.counters[name]
+	if !ok {
+		series = map[metricLabels]float64{}
+		m.counters[name] = series
+	}
+	series[l]++
+}
+
+func (m *Metrics) observe(name string, l metricLabels, d time.Duration) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	series, ok := m.histograms[name]
+	if !ok {
+		series = map[metricLabels]*histogram{}
+		m.histograms[name] = series
+	}
+	h, ok := series[l]
+	if !ok {
+		h = &histogram{counts: make([]uint64, len(handlerBuckets))}
+		series[l] = h
+	}
+	v := d.Seconds()
+	for i, le := range handlerBuckets {
+		if v <= le {
+			h.counts[i]++
+		}
+	}
+	h.sum += v
+	h.count++
+}
+
+func (m *Metrics) recordAck(l metricLabels, ack SimpleAckType) {
+	switch ack {
+	case Ack:
+		m.inc(metricAcked, l)
+	case NackRequeue:
+		m.inc(metricNackedRequeue, l)
+	case NackDiscard:
+		m.inc(metricNackedDiscard, l)
+	}
+}
+
+// WrapPublisher counts every successful publish made through p, labelled by
+// exchange and the publishing's Type.
+func (m *Metrics) WrapPublisher(p Publisher) Publisher {
+	return metricsPublisher{p: p, m: m}
+}
+
+type metricsPublisher struct {
+	p Publisher
+	m *Metrics
+}
+
+func (mp metricsPublisher) PublishWithContext(ctx context.Context, exchange, key string, mandatory, immediate bool, msg amqp.Publishing) error {
+	err := mp.p.PublishWithContext(ctx, exchange, key, mandatory, immediate, msg)
+	if err == nil {
+		mp.m.inc(metricPublished, metricLabels{exchange: exchange, typ: msg.Type})
+	}
+	return err
+}
+
+// ListenAndServe serves the metrics at /metrics on addr until the server
+// fails.
+func (m *Metrics) ListenAndServe(addr string) error {
+	mux := http.NewServeMux()
+	mux.Handle("/metrics", m)
+	return http.ListenAndServe(addr, mux)
+}
+
+func (m *Metrics) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "text/plain; version=0.0.4")
+	m.WriteTo(w)
+}
+
+// WriteTo writes every metric in the Prometheus text exposition format.
+func (m *Metrics) WriteTo(w io.Writer) (int64, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	var b strings.Builder
+	for _, f := range metricFamilies {
+		fmt.Fprintf(&b, "# HELP %s %s\n# TYPE %s %s\n", f.name, f.help, f.name, f.kind)
+		if f.kind == "histogram" {
+			series := m.histograms[f.name]
+			for _, l := range sortedLabels(series) {
+				h := series[l]
+				for i, le := range handlerBuckets {
+					fmt.Fprintf(&b, "%s_bucket%s %d\n", f.name, l.format(fmt.Sprintf("%g", le)), h.counts[i])
+				}
+				fmt.Fprintf(&b, "%s_bucket%s %d\n", f.name, l.format("+Inf"), h.count)
+				fmt.Fprintf(&b, "%s_sum%s %g\n", f.name, l.format(""), h.sum)
+				fmt.Fprintf(&b, "%s_count%s %d\n", f.name, l.format(""), h.count)
+			}
+			continue
+		}
+		series := m.counters[f.name]
+		for _, l := range sortedLabels(series) {
+			fmt.Fprintf(&b, "%s%s %g\n", f.name, l.format(""), series[l])
+		}
+	}
+	n, err := io.WriteString(w, b.String())
+	return int64(n), err
+}
+
+func sortedLabels[V any](series map[metricLabels]V) []metricLabels {
+	labels := make([]metricLabels, 0, len(series))
+	for l := range series {
+		labels = append(labels, l)
+	}
+	sort.Slice(labels, func(i, j int) bool {
+		return labels[i].format("") < labels[j].format("")
+	})
+	return labels
+}
+
+func (l metricLabels) format(le string) string {
+	parts := []string{fmt.Sprintf(`exchange="%s"`, escapeLabel(l.exchange))}
+	if l.queue != "" {
+		parts = append(parts, fmt.Sprintf(`queue="%s"`, escapeLabel(l.queue)))
+	}
+	parts = append(parts, fmt.Sprintf(`type="%s"`, escapeLabel(l.typ)))
+	if le != "" {
+		parts = append(parts, fmt.Sprintf(`le="%s"`, le))
+	}
+	return "{" + strings.Join(parts, ",") + "}"
+}
+
+func escapeLabel(v string) string {
+	return strings.NewReplacer(`\`, `\\`, `"`, `\"`, "\n", `\n`).Replace(v)
+}
@@ -0,0 +1,98 @@
+package pubsub
+
+import (
+	"context"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/bootdotdev/learn-pub-sub-starter/internal/routing"
+)
+
+func TestMetricsWriteTo(t *testing.T) {
+	m := NewMetrics()
+	l := metricLabels{exchange: "peril_topic", queue: "game_logs", typ: `say "hi"`}
+	m.inc(metricAcked, l)
+	m.inc(metricAcked, l)
+	m.observe(metricHandlerTime, l, 3*time.Millisecond)
+
+	var b strings.Builder
+	if _, err := m.WriteTo(&b); err != nil {
+		t.Fatal(err)
+	}
+	out := b.String()
+	labels := `exchange="peril_topic",queue="game_logs",type="say \"hi\""`
+	for _, want := range []string{
+		"# HELP peril_messages_acked_total Deliveries acked after handling.\n# TYPE peril_messages_acked_total counter\n",
+		"peril_messages_acked_total{" + labels + "} 2\n",
+		"# TYPE peril_handler_duration_seconds histogram\n",
+		"peril_handler_duration_seconds_bucket{" + labels + `,le="0.001"} 0` + "\n",
+		"peril_handler_duration_seconds_bucket{" + labels + `,le="0.005"} 1` + "\n",
+		"peril_handler_duration_seconds_bucket{" + labels + `,le="10"} 1` + "\n",
+		"peril_handler_duration_seconds_bucket{" + labels + `,le="+Inf"} 1` + "\n",
+		"peril_handler_duration_seconds_sum{" + labels + "} 0.003\n",
+		"peril_handler_duration_seconds_count{" + labels + "} 1\n",
+	} {
+		if !strings.Contains(out, want) {
+			t.Errorf("output is missing %q:\n%s", want, out)
+		}
+	}
+	// Families with no series still get their HELP and TYPE lines.
+	if !strings.Contains(out, "# TYPE peril_decode_errors_total counter\n") {
+		t.Errorf("output is missing the decode errors family:\n%s", out)
+	}
+}
+
+func TestSubscriptionMetrics(t *testing.T) {
+	b := newTestBroker(t)
+	m := NewMetrics()
+	handled := make(chan struct{}, 2)
+	sub, err := Subscribe(context.Background(), b, routing.ExchangePerilTopic, routing.GameLogSlug, routing.GameLogSlug+".*", DurableQueue,
+		func(gl routing.GameLog) SimpleAckType {
+			defer func() { handled <- struct{}{} }()
+			if gl.Username == "mallory" {
+				return NackDiscard
+			}
+			return Ack
+		},
+		WithMetrics(m),
+	)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer sub.Close()
+	pub := m.WrapPublisher(testChannel(t, b))
+	for _, user := range []string{"alice", "mallory"} {
+		if err := PublishJSON(pub, routing.ExchangePerilTopic, routing.GameLogSlug+"."+user, routing.GameLog{Username: user}); err != nil {
+			t.Fatal(err)
+		}
+	}
+	for range 2 {
+		select {
+		case <-handled:
+		case <-time.After(time.Second):
+			t.Fatal("messages weren't handled")
+		}
+	}
+	// The handler's result is recorded after it returns.
+	sub.Close()
+
+	rec := httptest.NewRecorder()
+	m.ServeHTTP(rec, httptest.NewRequest("GET", "/metrics", nil))
+	if ct := rec.Header().Get("Content-Type"); !strings.HasPrefix(ct, "text/plain") {
+		t.Errorf("served content type %q", ct)
+	}
+	out := rec.Body.String()
+	sublabels := `{exchange="peril_topic",queue="game_logs",type="routing.GameLog"}`
+	for _, want := range []string{
+		`peril_messages_published_total{exchange="peril_topic",type="routing.GameLog"} 2`,
+		"peril_messages_acked_total" + sublabels + " 1",
+		"peril_messages_nacked_discard_total" + sublabels + " 1",
+		"peril_handler_duration_seconds_count" + sublabels + " 2",
+	} {
+		if !strings.Contains(out, want+"\n") {
+			t.Errorf("output is missing %q:\n%s", want, out)
+		}
+	}
+}
@@ -0,0 +1,114 @@
+package pubsub
+
+import (
+	"context"
+	"time"
+
+	amqp "github.com/rabbitmq/amqp091-go"
+)
+
+// Message is a decoded delivery on its way to a handler.
+type Message struct {
+	Delivery amqp.Delivery
+	Metadata Metadata
+	Value    any
+}
+
+type HandlerFunc func(ctx context.Context, msg Message) SimpleAckType
+
+// Middleware wraps a handler with behaviour that applies to every message,
+// whatever its type.
+type Middleware func(next HandlerFunc) HandlerFunc
+
+// WithMiddleware wraps the subscription's handler. The first middleware is
+// the outermost, so it sees each message first and its result last.
+func WithMiddleware(mw ...Middleware) SubscribeOption {
+	return func(o *subscribeOptions) {
+		o.middleware = append(o.middleware, mw...)
+	}
+}
+
+func chain(mw []Middleware, h HandlerFunc) HandlerFunc {
+	for i := len(mw) - 1; i >= 0; i-- {
+		h = mw[i](h)
+	}
+	return h
+}
+
+// Recover turns a panicking handler into a NackDiscard. onPanic may be nil.
+func Recover(onPanic func(msg Message, v any)) Middleware {
+	return func(next HandlerFunc) HandlerFunc {
+		return func(ctx context.Context, msg Message) (ack SimpleAckType) {
+			defer func() {
+				if v := recover(); v != nil {
+					if onPanic != nil {
+						onPanic(msg, v)
+					}
+					ack = NackDiscard
+				}
+			}()
+			return next(ctx, msg)
+		}
+	}
+}
+
+// Timing reports how long each handler call took.
+func Timing(observe func(msg Message, ack SimpleAckType, elapsed time.Duration)) Middleware {
+	return func(next HandlerFunc) HandlerFunc {
+		return func(ctx context.Context, msg Message) SimpleAckType {
+			start := time.Now()
+			ack := next(ctx, msg)
+			observe(msg, ack, time.Since(start))
+			return ack
+		}
+	}
+}
+
+// Logging prints one line per handled message.
+func Logging(printf func(format string, args ...any)) Middleware {
+	return func(next HandlerFunc) HandlerFunc {
+		return func(ctx context.Context, msg Message) SimpleAckType {
+			ack := next(ctx, msg)
+			printf("%s %s: %s", msg.Delivery.Exchange, msg.Delivery.RoutingKey, ack)
+			return ack
+		}
+	}
+}
+
+// Timeout gives up on a handler call after d and requeues the message. The
+// handler's context is cancelled, but a handler that ignores it keeps
+// running in the background and its result is dropped.
+func Timeout(d time.Duration) Middleware {
+	return func(next HandlerFunc) HandlerFunc {
+		return func(ctx context.Context, msg Message) SimpleAckType {
+			ctx, cancel := context.WithTimeout(ctx, d)
+			defer cancel()
+			result := make(chan SimpleAckType, 1)
+			go func() {
+				result <- next(ctx, msg)
+			}()
+			select {
+			case ack := <-result:
+				return ack
+			case <-ctx.Done():
+				return NackRequeue
+			}
+		}
+	}
+}
+
+// Hook runs before and after every handler call. Either may be nil.
+func Hook(before func(ctx context.Context, msg Message), after func(ctx context.Context, msg Message, ack SimpleAckType)) Middleware {
+	return func(next HandlerFunc) HandlerFunc {
+		return func(ctx context.Context, msg Message) SimpleAckType {
+			if before != nil {
+				before(ctx, msg)
+			}
+			ack := next(ctx, msg)
+			if after != nil {
+				after(ctx, msg, ack)
+			}
+			return ack
+		}
+	}
+}
@@ -0,0 +1,124 @@
+package pubsub
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/bootdotdev/learn-pub-sub-starter/internal/routing"
+	amqp "github.com/rabbitmq/amqp091-go"
+)
+
+func TestMiddlewareOrder(t *testing.T) {
+	var calls []string
+	record := func(name string) Middleware {
+		return Hook(
+			func(ctx context.Context, msg Message) { calls = append(calls, name+" before") },
+			func(ctx context.Context, msg Message, ack SimpleAckType) { calls = append(calls, name+" after") },
+		)
+	}
+	h := chain([]Middleware{record("outer"), record("inner")}, func(ctx context.Context, msg Message) SimpleAckType {
+		calls = append(calls, "handler")
+		return Ack
+	})
+	h(context.Background(), Message{})
+	want := []string{"outer before", "inner before", "handler", "inner after", "outer after"}
+	if !reflect.DeepEqual(calls, want) {
+		t.Errorf("got calls %v, want %v", calls, want)
+	}
+}
+
+func TestRecover(t *testing.T) {
+	var recovered any
+	h := Recover(func(msg Message, v any) { recovered = v })(func(ctx context.Context, msg Message) SimpleAckType {
+		panic("boom")
+	})
+	if ack := h(context.Background(), Message{}); ack != NackDiscard {
+		t.Errorf("got %v, want NackDiscard", ack)
+	}
+	if recovered != "boom" {
+		t.Errorf("onPanic got %v, want boom", recovered)
+	}
+
+	h = Recover(nil)(func(ctx context.Context, msg Message) SimpleAckType { return Ack })
+	if ack := h(context.Background(), Message{}); ack != Ack {
+		t.Errorf("got %v from a handler that didn't panic, want Ack", ack)
+	}
+}
+
+func TestTimeout(t *testing.T) {
+	cancelled := make(chan error, 1)
+	slow := Timeout(10 * time.Millisecond)(func(ctx context.Context, msg Message) SimpleAckType {
+		<-ctx.Done()
+		cancelled <- ctx.Err()
+		return Ack
+	})
+	if ack := slow(context.Background(), Message{}); ack != NackRequeue {
+		t.Errorf("slow handler got %v, want NackRequeue", ack)
+	}
+	if err := <-cancelled; !errors.Is(err, context.DeadlineExceeded) {
+		t.Errorf("slow handler's context ended with %v", err)
+	}
+
+	fast := Timeout(time.Second)(func(ctx context.Context, msg Message) SimpleAckType { return NackDiscard })
+	if ack := fast(context.Background(), Message{}); ack != NackDiscard {
+		t.Errorf("fast handler got %v, want its own NackDiscard", ack)
+	}
+}
+
+func TestTimingAndLogging(t *testing.T) {
+	var (
+		observed time.Duration
+		line     string
+	)
+	h := chain([]Middleware{
+		Logging(func(format string, args ...any) { line = fmt.Sprintf(format, args...) }),
+		Timing(func(msg Message, ack SimpleAckType, elapsed time.Duration) { observed = elapsed }),
+	}, func(ctx context.Context, msg Message) SimpleAckType {
+		time.Sleep(5 * time.Millisecond)
+		return Ack
+	})
+	h(context.Background(), Message{Delivery: amqp.Delivery{Exchange: routing.ExchangePerilTopic, RoutingKey: "game_logs.alice"}})
+	if observed < 5*time.Millisecond {
+		t.Errorf("observed %v, want at least 5ms", observed)
+	}
+	if want := fmt.Sprintf("%s game_logs.alice: %s", routing.ExchangePerilTopic, Ack); line != want {
+		t.Errorf("logged %q, want %q", line, want)
+	}
+}
+
+func TestSubscriptionMiddlewareSeesDecodedMessage(t *testing.T) {
+	b := newTestBroker(t)
+	seen := make(chan Message, 1)
+	sub, err := Subscribe(context.Background(), b, routing.ExchangePerilTopic, routing.GameLogSlug, routing.GameLogSlug+".*", DurableQueue,
+		func(gl routing.GameLog) SimpleAckType { panic("boom") },
+		WithMiddleware(
+			Hook(func(ctx context.Context, msg Message) { seen <- msg }, nil),
+			Recover(nil),
+		),
+	)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer sub.Close()
+	err = Publish(context.Background(), testChannel(t, b), routing.ExchangePerilTopic, "game_logs.alice", routing.GameLog{Username: "alice"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	select {
+	case msg := <-seen:
+		if gl, ok := msg.Value.(routing.GameLog); !ok || gl.Username != "alice" {
+			t.Errorf("middleware got value %#v, want alice's log", msg.Value)
+		}
+		if msg.Delivery.RoutingKey != "game_logs.alice" {
+			t.Errorf("middleware got routing key %q", msg.Delivery.RoutingKey)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("middleware never ran")
+	}
+	// The recovered panic discards the message.
+	waitFor(t, "message to be dead-lettered", func() bool { return b.QueueLen(routing.DeadLetterQueue) == 1 })
+}
@@ -0,0 +1,288 @@
+package pubsub
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"log/slog"
+	"os"
+	"sync"
+	"time"
+
+	amqp "github.com/rabbitmq/amqp091-go"
+)
+
+const (
+	relayMinBackoff = 500 * time.Millisecond
+	relayMaxBackoff = 30 * time.Second
+)
+
+// OutboxMessage is an encoded message ready to be recorded in an outbox.
+type OutboxMessage struct {
+	exchange string
+	key      string
+	msg      amqp.Publishing
+}
+
+// NewOutboxMessage encodes val the way Publish would, so that encoding
+// errors turn up before anything is recorded.
+func NewOutboxMessage[T any](ctx context.Context, exchange, key string, val T, opts ...PublishOption) (OutboxMessage, error) {
+	msg, err := newPublishing(ctx, val, opts)
+	if err != nil {
+		return OutboxMessage{}, err
+	}
+	return OutboxMessage{exchange: exchange, key: key, msg: msg}, nil
+}
+
+// outboxRecord is one line of the outbox file: a message waiting to be
+// published, or a note that the message with ID was sent.
+type outboxRecord struct {
+	ID       string           `json:"id"`
+	Exchange string           `json:"exchange,omitempty"`
+	Key      string           `json:"key,omitempty"`
+	Msg      *amqp.Publishing `json:"msg,omitempty"`
+	Sent     bool             `json:"sent,omitempty"`
+}
+
+// Outbox durably records messages alongside the local state changes they
+// announce, and relays them to the broker once it will take them. A message
+// recorded in the outbox is published at least once, even if the process
+// crashes or the broker is down when it is recorded; subscribers should
+// deduplicate by message ID.
+type Outbox struct {
+	mu      sync.Mutex
+	f       *os.File
+	path    string
+	pending []outboxRecord
+	wake    chan struct{}
+	log     *slog.Logger
+}
+
+type OutboxOption func(*Outbox)
+
+// WithOutboxLogger sets the logger for relay failures.
+func WithOutboxLogger(l *slog.Logger) OutboxOption {
+	return func(o *Outbox) {
+		o.log = l
+	}
+}
+
+// OpenOutbox loads the messages at path that haven't been sent yet and
+// rewrites the file with just those.
+func OpenOutbox(path string, opts ...OutboxOption) (*Outbox, error) {
+	o := &Outbox{path: path, wake: make(chan struct{}, 1), log: silentLogger}
+	for _, opt := range opts {
+		opt(o)
+	}
+	f, err := os.Open(path)
+	if err != nil && !os.IsNotExist(err) {
+		return nil, err
+	}
+	if err == nil {
+		sent := map[string]bool{}
+		sc := bufio.NewScanner(f)
+		sc.Buffer(nil, 16<<20)
+		for sc.Scan() {
+			line := bytes.TrimSpace(sc.Bytes())
+			if len(line) == 0 {
+				continue
+			}
+			var r outboxRecord
+			err := json.Unmarshal(line, &r)
+			if err != nil {
+				// A crash can leave the last line half written. Its
+				// message was never acknowledged to the caller.
+				o.log.Warn("skipping unreadable outbox record", "path", path, "error", err)
+				continue
+			}
+			if r.Sent {
+				sent[r.ID] = true
+				continue
+			}
+			if r.Msg != nil {
+				r.Msg.Headers = restoreHeaderInts(r.Msg.Headers)
+				o.pending = append(o.pending, r)
+			}
+		}
+		f.Close()
+		if err := sc.Err(); err != nil {
+			return nil, fmt.Errorf("reading outbox %s: %w", path, err)
+		}
+		unsent := o.pending[:0]
+		for _, r := range o.pending {
+			if !sent[r.ID] {
+				unsent = append(unsent, r)
+			}
+		}
+		o.pending = unsent
+	}
+	tmp := path + ".tmp"
+	out, err := os.Create(tmp)
+	if err != nil {
+		return nil, err
+	}
+	err = writeRecords(out, o.pending...)
+	if err == nil {
+		err = out.Close()
+	} else {
+		out.Close()
+	}
+	if err != nil {
+		return nil, err
+	}
+	err = os.Rename(tmp, path)
+	if err != nil {
+		return nil, err
+	}
+	o.f, err = os.OpenFile(path, os.O_APPEND|os.O_WRONLY, 0644)
+	if err != nil {
+		return nil, err
+	}
+	if len(o.pending) > 0 {
+		o.wake <- struct{}{}
+	}
+	return o, nil
+}
+
+// Record writes msgs to the outbox and, once they are on disk, makes the
+// state change they announce by calling apply. If writing fails, apply is
+// not called and nothing will be published. The relay doesn't see msgs
+// until apply has returned, so subscribers never hear of a change before
+// it has been made.
+func (o *Outbox) Record(apply func(), msgs ...OutboxMessage) error {
+	o.mu.Lock()
+	defer o.mu.Unlock()
+	records := make([]outboxRecord, len(msgs))
+	for i, m := range msgs {
+		msg := m.msg
+		records[i] = outboxRecord{ID: msg.MessageId, Exchange: m.exchange, Key: m.key, Msg: &msg}
+	}
+	fi, err := o.f.Stat()
+	if err != nil {
+		return err
+	}
+	err = writeRecords(o.f, records...)
+	if err != nil {
+		// Cut off anything partly written so the next record starts on a
+		// line of its own.
+		o.f.Truncate(fi.Size())
+		return fmt.Errorf("writing outbox %s: %w", o.path, err)
+	}
+	if apply != nil {
+		apply()
+	}
+	o.pending = append(o.pending, records...)
+	select {
+	case o.wake <- struct{}{}:
+	default:
+	}
+	return nil
+}
+
+// Pending reports how many recorded messages haven't been published yet.
+func (o *Outbox) Pending() int {
+	o.mu.Lock()
+	defer o.mu.Unlock()
+	return len(o.pending)
+}
+
+// Relay publishes recorded messages through p, in the order they were
+// recorded, until ctx is cancelled. A message is only marked sent once p
+// has accepted it, so p should wait for publisher confirms. Failed
+// publishes are retried with backoff. Only one Relay should run per outbox.
+func (o *Outbox) Relay(ctx context.Context, p Publisher) error {
+	backoff := relayMinBackoff
+	for {
+		r, ok := o.next()
+		if !ok {
+			select {
+			case <-ctx.Done():
+				return ctx.Err()
+			case <-o.wake:
+			}
+			continue
+		}
+		err := p.PublishWithContext(ctx, r.Exchange, r.Key, false, false, *r.Msg)
+		if err != nil {
+			if ctx.Err() != nil {
+				return ctx.Err()
+			}
+			o.log.Warn("error relaying outbox message", "message_id", r.ID, "retry_in", backoff, "error", err)
+			select {
+			case <-ctx.Done():
+				return ctx.Err()
+			case <-time.After(backoff):
+			}
+			backoff = min(backoff*2, relayMaxBackoff)
+			continue
+		}
+		backoff = relayMinBackoff
+		err = o.markSent(r.ID)
+		if err != nil {
+			o.log.Warn("error marking outbox message sent", "message_id", r.ID, "error", err)
+		}
+	}
+}
+
+func (o *Outbox) next() (outboxRecord, bool) {
+	o.mu.Lock()
+	defer o.mu.Unlock()
+	if len(o.pending) == 0 {
+		return outboxRecord{}, false
+	}
+	return o.pending[0], true
+}
+
+// markSent drops the oldest pending message. A lost sent marker only means
+// the message is published again after a restart, so it isn't synced. Once
+// nothing is pending the file is emptied.
+func (o *Outbox) markSent(id string) error {
+	o.mu.Lock()
+	defer o.mu.Unlock()
+	o.pending = o.pending[1:]
+	if len(o.pending) == 0 {
+		return o.f.Truncate(0)
+	}
+	line, err := json.Marshal(outboxRecord{ID: id, Sent: true})
+	if err != nil {
+		return err
+	}
+	_, err = o.f.Write(append(line, '\n'))
+	return err
+}
+
+func (o *Outbox) Close() error {
+	o.mu.Lock()
+	defer o.mu.Unlock()
+	return o.f.Close()
+}
+
+// writeRecords appends records to f in a single write and syncs it.
+func writeRecords(f *os.File, records ...outboxRecord) error {
+	var buf bytes.Buffer
+	enc := json.NewEncoder(&buf)
+	for _, r := range records {
+		err := enc.Encode(r)
+		if err != nil {
+			return err
+		}
+	}
+	_, err := f.Write(buf.Bytes())
+	if err != nil {
+		return err
+	}
+	return f.Sync()
+}
+
+// restoreHeaderInts turns the whole numbers JSON decoded as float64 back
+// into the int64s they were published as.
+func restoreHeaderInts(h amqp.Table) amqp.Table {
+	for k, v := range h {
+		if f, ok := v.(float64); ok && f == float64(int64(f)) {
+			h[k] = int64(f)
+		}
+	}
+	return h
+}
@@ -0,0 +1,188 @@
+package pubsub
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/bootdotdev/learn-pub-sub-starter/internal/routing"
+	amqp "github.com/rabbitmq/amqp091-go"
+)
+
+// recordingPublisher remembers what was published through it.
+type recordingPublisher struct {
+	mu   sync.Mutex
+	msgs []amqp.Publishing
+}
+
+func (p *recordingPublisher) PublishWithContext(ctx context.Context, exchange, key string, mandatory, immediate bool, msg amqp.Publishing) error {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.msgs = append(p.msgs, msg)
+	return nil
+}
+
+func (p *recordingPublisher) published() []amqp.Publishing {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	return append([]amqp.Publishing(nil), p.msgs...)
+}
+
+func recordLogs(t *testing.T, o *Outbox, messages ...string) []string {
+	t.Helper()
+	var ids []string
+	for _, m := range messages {
+		msg, err := NewOutboxMessage(context.Background(), routing.ExchangePerilTopic, "game_logs.alice", routing.GameLog{Username: "alice", Message: m})
+		if err != nil {
+			t.Fatal(err)
+		}
+		err = o.Record(nil, msg)
+		if err != nil {
+			t.Fatal(err)
+		}
+		ids = append(ids, msg.msg.MessageId)
+	}
+	return ids
+}
+
+// relay runs o's relay until n messages have gone out through p.
+func relay(t *testing.T, o *Outbox, p *recordingPublisher, n int) {
+	t.Helper()
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan struct{})
+	go func() {
+		o.Relay(ctx, p)
+		close(done)
+	}()
+	waitFor(t, "messages to be relayed", func() bool { return len(p.published()) >= n && o.Pending() == 0 })
+	cancel()
+	<-done
+}
+
+func TestOutboxRecoversUnsentMessages(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "outbox.jsonl")
+	o, err := OpenOutbox(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ids := recordLogs(t, o, "one", "two")
+	o.Close()
+
+	// A crash mid-write leaves half a record behind.
+	f, err := os.OpenFile(path, os.O_APPEND|os.O_WRONLY, 0644)
+	if err != nil {
+		t.Fatal(err)
+	}
+	f.WriteString(`{"id":"torn","exch`)
+	f.Close()
+
+	o, err = OpenOutbox(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer o.Close()
+	if n := o.Pending(); n != 2 {
+		t.Fatalf("%d messages pending after reopening, want 2", n)
+	}
+	p := &recordingPublisher{}
+	relay(t, o, p, 2)
+	got := p.published()
+	for i, id := range ids {
+		if got[i].MessageId != id {
+			t.Errorf("message %d is %s, want %s", i, got[i].MessageId, id)
+		}
+	}
+	if v, ok := got[0].Headers[HeaderSchemaVersion].(int64); !ok || v != defaultSchemaVersion {
+		t.Errorf("schema version header is %#v after reopening, want int64 %d", got[0].Headers[HeaderSchemaVersion], defaultSchemaVersion)
+	}
+	if _, err := decode[routing.GameLog](got[1].ContentType, got[1].Body); err != nil {
+		t.Errorf("relayed body doesn't decode: %v", err)
+	}
+}
+
+func TestOutboxForgetsSentMessages(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "outbox.jsonl")
+	o, err := OpenOutbox(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	recordLogs(t, o, "one")
+	relay(t, o, &recordingPublisher{}, 1)
+	ids := recordLogs(t, o, "two", "three")
+	o.Close()
+
+	o, err = OpenOutbox(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer o.Close()
+	p := &recordingPublisher{}
+	relay(t, o, p, 2)
+	got := p.published()
+	if len(got) != 2 || got[0].MessageId != ids[0] || got[1].MessageId != ids[1] {
+		t.Errorf("relayed %d messages after reopening, want just the 2 unsent", len(got))
+	}
+}
+
+func TestOutboxRecordAppliesOnlyOnceWritten(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "outbox.jsonl")
+	o, err := OpenOutbox(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	msg, err := NewOutboxMessage(context.Background(), routing.ExchangePerilTopic, "game_logs.alice", routing.GameLog{Username: "alice"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	applied := false
+	err = o.Record(func() { applied = true }, msg)
+	if err != nil || !applied {
+		t.Fatalf("Record returned %v, applied %v", err, applied)
+	}
+	o.Close()
+
+	// Once the file can't be written, nothing is applied or queued.
+	applied = false
+	err = o.Record(func() { applied = true }, msg)
+	if err == nil || applied {
+		t.Fatalf("Record on a closed file returned %v, applied %v", err, applied)
+	}
+	if n := o.Pending(); n != 1 {
+		t.Errorf("%d messages pending, want 1", n)
+	}
+}
+
+func TestOutboxRelaysToBroker(t *testing.T) {
+	b := newTestBroker(t)
+	o, err := OpenOutbox(filepath.Join(t.TempDir(), "outbox.jsonl"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer o.Close()
+	got := make(chan routing.GameLog, 1)
+	sub, err := Subscribe(context.Background(), b, routing.ExchangePerilTopic, routing.GameLogSlug, routing.GameLogSlug+".*", DurableQueue,
+		func(gl routing.GameLog) SimpleAckType {
+			got <- gl
+			return Ack
+		},
+	)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer sub.Close()
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	go o.Relay(ctx, testChannel(t, b))
+	recordLogs(t, o, "hello")
+	select {
+	case gl := <-got:
+		if gl.Message != "hello" {
+			t.Errorf("got %q, want hello", gl.Message)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("recorded message never arrived")
+	}
+}
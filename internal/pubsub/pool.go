@@ -0,0 +1,185 @@
+package pubsub
+
+import (
+	"context"
+	"errors"
+	"sync"
+	"time"
+
+	amqp "github.com/rabbitmq/amqp091-go"
+)
+
+const (
+	defaultPoolSize = 4
+	// poolAttempts is how many fresh channels a publish tries before
+	// giving up on a broker that keeps closing them.
+	poolAttempts     = 3
+	poolRetryBackoff = 100 * time.Millisecond
+)
+
+// PublisherPool publishes through a pool of channels. An AMQP channel must
+// not be published on from two goroutines at once, so each publish borrows
+// a channel of its own, opening one if none is idle, and up to size
+// publishes run in parallel. When the broker closes a channel, every idle
+// channel is dropped with it and the publish retried on a fresh one. Only
+// fresh channels count towards the few attempts a publish makes, with
+// backoff, so a publish after a reconnect doesn't fail on stale channels.
+type PublisherPool struct {
+	open           func(context.Context) (Channel, error)
+	confirmTimeout time.Duration
+	slots          chan struct{}
+
+	mu     sync.Mutex
+	idle   []pooledChannel
+	closed bool
+}
+
+type pooledChannel struct {
+	ch  Channel
+	pub Publisher
+}
+
+type PoolOption func(*PublisherPool)
+
+// WithPoolConfirms puts every channel in the pool into confirm mode and
+// makes each publish wait up to timeout for the broker to ack it.
+func WithPoolConfirms(timeout time.Duration) PoolOption {
+	return func(p *PublisherPool) {
+		p.confirmTimeout = timeout
+	}
+}
+
+func NewPublisherPool(conn Subscriber, size int, opts ...PoolOption) *PublisherPool {
+	return newPublisherPool(func(context.Context) (Channel, error) {
+		return conn.Channel()
+	}, size, opts)
+}
+
+func newPublisherPool(open func(context.Context) (Channel, error), size int, opts []PoolOption) *PublisherPool {
+	if size < 1 {
+		size = 1
+	}
+	p := &PublisherPool{
+		open:  open,
+		slots: make(chan struct{}, size),
+	}
+	for _, opt := range opts {
+		opt(p)
+	}
+	return p
+}
+
+func (p *PublisherPool) PublishWithContext(ctx context.Context, exchange, key string, mandatory, immediate bool, msg amqp.Publishing) error {
+	select {
+	case p.slots <- struct{}{}:
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+	defer func() { <-p.slots }()
+	var err error
+	for attempt := 0; attempt < poolAttempts; {
+		var pc pooledChannel
+		var fresh bool
+		pc, fresh, err = p.get(ctx)
+		if err == nil {
+			err = pc.pub.PublishWithContext(ctx, exchange, key, mandatory, immediate, msg)
+			if !errors.Is(err, amqp.ErrClosed) {
+				p.put(pc)
+				return err
+			}
+			pc.ch.Close()
+			// The idle channels most likely went down with this one.
+			p.dropIdle()
+			if !fresh {
+				continue
+			}
+		} else if !errors.Is(err, amqp.ErrClosed) || p.isClosed() {
+			return err
+		}
+		attempt++
+		if attempt < poolAttempts {
+			if err := sleepContext(ctx, poolRetryBackoff<<(attempt-1)); err != nil {
+				return err
+			}
+		}
+	}
+	return err
+}
+
+func sleepContext(ctx context.Context, d time.Duration) error {
+	select {
+	case <-ctx.Done():
+		return ctx.Err()
+	case <-time.After(d):
+		return nil
+	}
+}
+
+func (p *PublisherPool) isClosed() bool {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	return p.closed
+}
+
+// get borrows an idle channel or opens a fresh one, reporting which.
+func (p *PublisherPool) get(ctx context.Context) (pooledChannel, bool, error) {
+	p.mu.Lock()
+	if p.closed {
+		p.mu.Unlock()
+		return pooledChannel{}, false, amqp.ErrClosed
+	}
+	if n := len(p.idle); n > 0 {
+		pc := p.idle[n-1]
+		p.idle = p.idle[:n-1]
+		p.mu.Unlock()
+		return pc, false, nil
+	}
+	p.mu.Unlock()
+	ch, err := p.open(ctx)
+	if err != nil {
+		return pooledChannel{}, true, err
+	}
+	if p.confirmTimeout <= 0 {
+		return pooledChannel{ch: ch, pub: ch}, true, nil
+	}
+	cp, err := NewConfirmPublisher(ch, p.confirmTimeout)
+	if err != nil {
+		ch.Close()
+		return pooledChannel{}, true, err
+	}
+	return pooledChannel{ch: ch, pub: cp}, true, nil
+}
+
+func (p *PublisherPool) put(pc pooledChannel) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if p.closed {
+		pc.ch.Close()
+		return
+	}
+	p.idle = append(p.idle, pc)
+}
+
+// dropIdle closes the idle channels, so the next publishes open fresh ones.
+func (p *PublisherPool) dropIdle() {
+	p.mu.Lock()
+	idle := p.idle
+	p.idle = nil
+	p.mu.Unlock()
+	for _, pc := range idle {
+		pc.ch.Close()
+	}
+}
+
+// Close closes the idle channels. Channels still in use are closed when
+// their publish finishes.
+func (p *PublisherPool) Close() error {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.closed = true
+	for _, pc := range p.idle {
+		pc.ch.Close()
+	}
+	p.idle = nil
+	return nil
+}
@@ -0,0 +1,112 @@
+package pubsub
+
+import (
+	"context"
+	"errors"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	amqp "github.com/rabbitmq/amqp091-go"
+)
+
+// closedChannel is a channel the broker has already closed.
+type closedChannel struct {
+	Channel
+}
+
+func (closedChannel) PublishWithContext(ctx context.Context, exchange, key string, mandatory, immediate bool, msg amqp.Publishing) error {
+	return amqp.ErrClosed
+}
+
+func (closedChannel) Close() error { return nil }
+
+func TestPoolGivesUpOnClosedChannels(t *testing.T) {
+	var opened atomic.Int32
+	p := newPublisherPool(func(context.Context) (Channel, error) {
+		opened.Add(1)
+		return closedChannel{}, nil
+	}, 1, nil)
+	defer p.Close()
+	start := time.Now()
+	err := p.PublishWithContext(context.Background(), "", "q", false, false, amqp.Publishing{})
+	if !errors.Is(err, amqp.ErrClosed) {
+		t.Fatalf("got %v, want ErrClosed", err)
+	}
+	if n := opened.Load(); n != poolAttempts {
+		t.Errorf("opened %d channels, want %d", n, poolAttempts)
+	}
+	if elapsed := time.Since(start); elapsed < poolRetryBackoff {
+		t.Errorf("retried after %v, want backoff of at least %v", elapsed, poolRetryBackoff)
+	}
+}
+
+func TestPoolStopsRetryingWhenContextDone(t *testing.T) {
+	p := newPublisherPool(func(context.Context) (Channel, error) {
+		return closedChannel{}, nil
+	}, 1, nil)
+	defer p.Close()
+	ctx, cancel := context.WithTimeout(context.Background(), poolRetryBackoff/2)
+	defer cancel()
+	err := p.PublishWithContext(ctx, "", "q", false, false, amqp.Publishing{})
+	if !errors.Is(err, context.DeadlineExceeded) {
+		t.Fatalf("got %v, want context.DeadlineExceeded", err)
+	}
+}
+
+func TestPublisherForPoolsChannels(t *testing.T) {
+	b := NewMemoryBroker()
+	if _, ok := publisherFor(b, 4).(*PublisherPool); !ok {
+		t.Error("memory broker channels are published on directly")
+	}
+	c := &Conn{}
+	if publisherFor(c, 4) != Publisher(c) {
+		t.Error("Conn's own pool is not used")
+	}
+}
+
+func TestPoolWaitsOutReconnect(t *testing.T) {
+	conn := &flakyConn{MemoryBroker: newTestBroker(t)}
+	ch := testChannel(t, conn.MemoryBroker)
+	_, err := ch.QueueDeclare("q", false, false, false, false, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	p := newPublisherPool(conn.channel, defaultPoolSize, nil)
+	defer p.Close()
+	// Fill the pool with more idle channels than a publish has attempts.
+	var borrowed []pooledChannel
+	for i := 0; i < defaultPoolSize; i++ {
+		pc, _, err := p.get(context.Background())
+		if err != nil {
+			t.Fatal(err)
+		}
+		borrowed = append(borrowed, pc)
+	}
+	for _, pc := range borrowed {
+		p.put(pc)
+	}
+
+	conn.drop()
+	published := make(chan error, 1)
+	go func() {
+		published <- p.PublishWithContext(context.Background(), "", "q", false, false, amqp.Publishing{Body: []byte("hi")})
+	}()
+	select {
+	case err := <-published:
+		t.Fatalf("publish returned %v while the broker was down", err)
+	case <-time.After(50 * time.Millisecond):
+	}
+	conn.restore()
+	select {
+	case err := <-published:
+		if err != nil {
+			t.Fatalf("publish after reconnect: %v", err)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("publish still blocked after reconnect")
+	}
+	if n := conn.QueueLen("q"); n != 1 {
+		t.Errorf("queue has %d messages, want 1", n)
+	}
+}
@@ -1,14 +1,10 @@
 package pubsub
 
 import (
-	"bytes"
-	"encoding/gob"
-	"encoding/json"
-	"fmt"
-
 	"context"
+	"fmt"
+	"time"
 
-	"github.com/bootdotdev/learn-pub-sub-starter/internal/routing"
 	amqp "github.com/rabbitmq/amqp091-go"
 )
 
@@ -27,67 +23,74 @@ const (
 	NackDiscard
 )
 
+func (a SimpleAckType) String() string {
+	switch a {
+	case Ack:
+		return "ack"
+	case NackRequeue:
+		return "nack-requeue"
+	case NackDiscard:
+		return "nack-discard"
+	default:
+		return fmt.Sprintf("SimpleAckType(%d)", int(a))
+	}
+}
+
 func SubscribeJSON[T any](
-	conn *amqp.Connection,
+	ctx context.Context,
+	conn Subscriber,
 	exchange,
 	queueName,
 	key string,
 	queueType simpleQueueType, // an enum to represent "durable" or "transient"
 	handler func(T) SimpleAckType,
-) error {
-	chann, q, err := DeclareAndBind(conn, exchange, queueName, key, queueType)
-	if err != nil {
-		return err
-	}
-	msgs, err := chann.Consume(
-		q.Name,
-		"",
-		false,
-		false,
-		false,
-		false,
-		nil,
-	)
-	if err != nil {
-		chann.Close()
-		return err
+	opts ...SubscribeOption,
+) (*Subscription, error) {
+	return Subscribe(ctx, conn, exchange, queueName, key, queueType, handler, opts...)
+}
+
+// PublishJSON publishes val as JSON under a new trace. Use
+// PublishJSONContext with a handler's context to record the message as
+// caused by the one being handled.
+func PublishJSON[T any](ch Publisher, exchange, key string, val T) error {
+	return PublishJSONContext(context.Background(), ch, exchange, key, val)
+}
+
+// PublishJSONContext publishes val as JSON, carrying ctx's trace.
+func PublishJSONContext[T any](ctx context.Context, ch Publisher, exchange, key string, val T) error {
+	return Publish(ctx, ch, exchange, key, val, WithCodec(JSON))
+}
+
+type PublishOption func(*publishOptions)
+
+type publishOptions struct {
+	codec         Codec
+	appID         string
+	schemaVersion int
+}
+
+// WithCodec picks the codec used to encode the message. The default is JSON.
+func WithCodec(c Codec) PublishOption {
+	return func(o *publishOptions) {
+		o.codec = c
 	}
-	go func() {
-		for d := range msgs {
-			var val T
-			if err := json.Unmarshal(d.Body, &val); err == nil {
-				switch handler(val) {
-				case Ack:
-					d.Ack(false)
-					fmt.Println("Acked message")
-				case NackRequeue:
-					d.Nack(false, true)
-					fmt.Println("Nacked message, requeued")
-				case NackDiscard:
-					d.Nack(false, false)
-					fmt.Println("Nacked message, discarded")
-				}
-			}
-		}
-	}()
-	return nil
 }
 
-func PublishJSON[T any](ch *amqp.Channel, exchange, key string, val T) error {
-	data, err := json.Marshal(val)
+// Publish encodes val and publishes it. The message carries ctx's trace
+// context and, inside a handler, the ID of the message being handled as its
+// causation ID.
+func Publish[T any](ctx context.Context, ch Publisher, exchange, key string, val T, opts ...PublishOption) error {
+	msg, err := newPublishing(ctx, val, opts)
 	if err != nil {
 		return err
 	}
 	err = ch.PublishWithContext(
-		context.Background(),
+		ctx,
 		exchange,
 		key,
 		false,
 		false,
-		amqp.Publishing{
-			Body:        data,
-			ContentType: "application/json",
-		},
+		msg,
 	)
 	if err != nil {
 		return err
@@ -95,17 +98,114 @@ func PublishJSON[T any](ch *amqp.Channel, exchange, key string, val T) error {
 	return nil
 }
 
+// newPublishing encodes val and fills in the envelope and trace headers.
+func newPublishing[T any](ctx context.Context, val T, opts []PublishOption) (amqp.Publishing, error) {
+	o := publishOptions{codec: JSON, appID: defaultAppID, schemaVersion: defaultSchemaVersion}
+	for _, opt := range opts {
+		opt(&o)
+	}
+	msg := amqp.Publishing{
+		Headers:     amqp.Table{HeaderSchemaVersion: int64(o.schemaVersion)},
+		ContentType: o.codec.ContentType(),
+		MessageId:   newMessageID(),
+		Timestamp:   time.Now(),
+		AppId:       o.appID,
+		Type:        fmt.Sprintf("%T", val),
+	}
+	err := encodeInto(o.codec, val, &msg)
+	if err != nil {
+		return amqp.Publishing{}, err
+	}
+	injectTrace(ctx, &msg)
+	return msg, nil
+}
+
+// Subscribe consumes from the queue and decodes each delivery with the codec
+// registered for its ContentType, so producers using different codecs can
+// share a queue.
+func Subscribe[T any](
+	ctx context.Context,
+	conn Subscriber,
+	exchange,
+	queueName,
+	key string,
+	queueType simpleQueueType,
+	handler func(T) SimpleAckType,
+	opts ...SubscribeOption,
+) (*Subscription, error) {
+	return subscribe(ctx, conn, exchange, queueName, key, queueType, func(_ context.Context, val T) SimpleAckType {
+		return handler(val)
+	}, opts)
+}
+
+// SubscribeContext is Subscribe for handlers that need the delivery's
+// context. It carries the trace of the message being handled, so anything
+// the handler publishes with it is recorded as caused by that message.
+func SubscribeContext[T any](
+	ctx context.Context,
+	conn Subscriber,
+	exchange,
+	queueName,
+	key string,
+	queueType simpleQueueType,
+	handler func(context.Context, T) SimpleAckType,
+	opts ...SubscribeOption,
+) (*Subscription, error) {
+	return subscribe(ctx, conn, exchange, queueName, key, queueType, handler, opts)
+}
+
 func DeclareAndBind(
-	conn *amqp.Connection,
+	conn Subscriber,
 	exchange,
 	queueName,
 	key string,
 	queueType simpleQueueType, // an enum to represent "durable" or "transient"
-) (*amqp.Channel, amqp.Queue, error) {
-	chann, err := conn.Channel()
+	opts ...QueueOption,
+) (Channel, amqp.Queue, error) {
+	o, err := newQueueOptions(queueType, opts)
 	if err != nil {
 		return nil, amqp.Queue{}, err
 	}
+	return declareAndBindContext(context.Background(), conn, exchange, queueName, key, queueType, o)
+}
+
+// declareAndBindContext is DeclareAndBind for callers that need to give up
+// waiting for a connection that is down.
+func declareAndBindContext(
+	ctx context.Context,
+	conn Subscriber,
+	exchange,
+	queueName,
+	key string,
+	queueType simpleQueueType,
+	o queueOptions,
+) (Channel, amqp.Queue, error) {
+	chann, err := openChannel(ctx, conn)
+	if err != nil {
+		return nil, amqp.Queue{}, err
+	}
+	queue, err := declareAndBind(chann, exchange, queueName, key, queueType, o)
+	if err != nil {
+		chann.Close()
+		return nil, amqp.Queue{}, err
+	}
+	if r, ok := conn.(topologyRecorder); ok {
+		r.recordTopology("queue:"+queueName+":"+exchange+":"+key, func(ch Channel) error {
+			_, err := declareAndBind(ch, exchange, queueName, key, queueType, o)
+			return err
+		})
+	}
+	return chann, queue, nil
+}
+
+func declareAndBind(
+	chann Channel,
+	exchange,
+	queueName,
+	key string,
+	queueType simpleQueueType,
+	o queueOptions,
+) (amqp.Queue, error) {
 	isDurable := (queueType == DurableQueue)
 	isTransient := (queueType == TransientQueue)
 	queue, err := chann.QueueDeclare(
@@ -114,11 +214,10 @@ func DeclareAndBind(
 		isTransient,
 		isTransient,
 		false,
-		amqp.Table{"x-dead-letter-exchange": routing.ExchangePerilDeadLetter},
+		o.args,
 	)
 	if err != nil {
-		chann.Close()
-		return nil, amqp.Queue{}, err
+		return amqp.Queue{}, err
 	}
 	err = chann.QueueBind(
 		queueName,
@@ -128,83 +227,32 @@ func DeclareAndBind(
 		nil,
 	)
 	if err != nil {
-		chann.Close()
-		return nil, amqp.Queue{}, err
+		return amqp.Queue{}, err
 	}
-	return chann, queue, nil
+	return queue, nil
 }
 
-func PublishGob[T any](ch *amqp.Channel, exchange, key string, val T) error {
-	var buf bytes.Buffer
-	enc := gob.NewEncoder(&buf)
-	if err := enc.Encode(val); err != nil {
-		return err
-	}
-	err := ch.PublishWithContext(
-		context.Background(),
-		exchange,
-		key,
-		false,
-		false,
-		amqp.Publishing{
-			Body:        buf.Bytes(),
-			ContentType: "application/gob",
-		},
-	)
-	if err != nil {
-		return err
-	}
-	return nil
+// PublishGob publishes val as gob under a new trace. Use PublishGobContext
+// with a handler's context to record the message as caused by the one
+// being handled.
+func PublishGob[T any](ch Publisher, exchange, key string, val T) error {
+	return PublishGobContext(context.Background(), ch, exchange, key, val)
+}
+
+// PublishGobContext publishes val as gob, carrying ctx's trace.
+func PublishGobContext[T any](ctx context.Context, ch Publisher, exchange, key string, val T) error {
+	return Publish(ctx, ch, exchange, key, val, WithCodec(Gob))
 }
 
 func SubscribeGob[T any](
-	conn *amqp.Connection,
+	ctx context.Context,
+	conn Subscriber,
 	exchange,
 	queueName,
 	key string,
 	queueType simpleQueueType,
 	handler func(T) SimpleAckType,
-) error {
-	chann, q, err := DeclareAndBind(conn, exchange, queueName, key, queueType)
-	if err != nil {
-		return err
-	}
-	err = chann.Qos(10, 0, false)
-	if err != nil {
-		fmt.Printf("error setting QoS: %v\n", err)
-		return err
-	}
-	msgs, err := chann.Consume(
-		q.Name,
-		"",
-		false,
-		false,
-		false,
-		false,
-		nil,
-	)
-	if err != nil {
-		chann.Close()
-		return err
-	}
-	go func() {
-		for d := range msgs {
-			var val T
-			dec := gob.NewDecoder(bytes.NewReader(d.Body))
-			if err := dec.Decode(&val); err == nil {
-				switch handler(val) {
-				case Ack:
-					d.Ack(false)
-					fmt.Println("Acked message")
-				case NackRequeue:
-					d.Nack(false, true)
-					fmt.Println("Nacked message, requeued")
-				case NackDiscard:
-					d.Nack(false, false)
-					fmt.Println("Nacked message, discarded")
-				}
-			}
-		}
-	}()
-	return nil
+	opts ...SubscribeOption,
+) (*Subscription, error) {
+	return Subscribe(ctx, conn, exchange, queueName, key, queueType, handler, opts...)
 }
@@ -0,0 +1,109 @@
+package pubsub
+
+import (
+	"errors"
+	"time"
+
+	"github.com/bootdotdev/learn-pub-sub-starter/internal/routing"
+	amqp "github.com/rabbitmq/amqp091-go"
+)
+
+// Overflow is what a queue does with new messages once it is full.
+type Overflow string
+
+const (
+	OverflowDropHead         Overflow = "drop-head"
+	OverflowRejectPublish    Overflow = "reject-publish"
+	OverflowRejectPublishDLX Overflow = "reject-publish-dlx"
+)
+
+type QueueOption func(*queueOptions)
+
+type queueOptions struct {
+	args   amqp.Table
+	quorum bool
+	lazy   bool
+}
+
+// WithQuorum makes the queue a replicated quorum queue. Quorum queues must
+// be durable.
+func WithQuorum() QueueOption {
+	return func(o *queueOptions) {
+		o.quorum = true
+		o.args["x-queue-type"] = "quorum"
+	}
+}
+
+// WithMessageTTL expires messages that have waited in the queue longer than
+// d. Expired messages are dead-lettered.
+func WithMessageTTL(d time.Duration) QueueOption {
+	return func(o *queueOptions) {
+		o.args["x-message-ttl"] = d.Milliseconds()
+	}
+}
+
+// WithMaxLength caps the queue at n ready messages.
+func WithMaxLength(n int, overflow Overflow) QueueOption {
+	return func(o *queueOptions) {
+		o.args["x-max-length"] = int64(n)
+		o.args["x-overflow"] = string(overflow)
+	}
+}
+
+// WithSingleActiveConsumer delivers to one consumer at a time; the others
+// take over only when it goes away.
+func WithSingleActiveConsumer() QueueOption {
+	return func(o *queueOptions) {
+		o.args["x-single-active-consumer"] = true
+	}
+}
+
+// WithLazyMode keeps a classic queue's messages on disk rather than in
+// memory.
+func WithLazyMode() QueueOption {
+	return func(o *queueOptions) {
+		o.lazy = true
+		o.args["x-queue-mode"] = "lazy"
+	}
+}
+
+// WithDeliveryLimit dead-letters a message after it has been redelivered n
+// times. Only quorum queues support it.
+func WithDeliveryLimit(n int) QueueOption {
+	return func(o *queueOptions) {
+		o.args["x-delivery-limit"] = int64(n)
+	}
+}
+
+// WithQueueArg sets any other x-argument.
+func WithQueueArg(key string, value any) QueueOption {
+	return func(o *queueOptions) {
+		o.args[key] = value
+	}
+}
+
+// WithQueueOptions declares the subscription's queue with opts.
+func WithQueueOptions(opts ...QueueOption) SubscribeOption {
+	return func(o *subscribeOptions) {
+		o.queue = append(o.queue, opts...)
+	}
+}
+
+func newQueueOptions(queueType simpleQueueType, opts []QueueOption) (queueOptions, error) {
+	o := queueOptions{
+		args: amqp.Table{"x-dead-letter-exchange": routing.ExchangePerilDeadLetter},
+	}
+	for _, opt := range opts {
+		opt(&o)
+	}
+	if o.quorum && queueType != DurableQueue {
+		return o, errors.New("quorum queues must be durable")
+	}
+	if o.quorum && o.lazy {
+		return o, errors.New("lazy mode only applies to classic queues")
+	}
+	if _, ok := o.args["x-delivery-limit"]; ok && !o.quorum {
+		return o, errors.New("delivery limits need a quorum queue")
+	}
+	return o, nil
+}
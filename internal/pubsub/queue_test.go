@@ -0,0 +1,110 @@
+package pubsub
+
+import (
+	"errors"
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/bootdotdev/learn-pub-sub-starter/internal/routing"
+	amqp "github.com/rabbitmq/amqp091-go"
+)
+
+func TestNewQueueOptions(t *testing.T) {
+	tests := []struct {
+		name      string
+		queueType simpleQueueType
+		opts      []QueueOption
+		want      amqp.Table
+		wantErr   bool
+	}{
+		{
+			name:      "defaults",
+			queueType: TransientQueue,
+			want:      amqp.Table{},
+		},
+		{
+			name:      "quorum with a delivery limit",
+			queueType: DurableQueue,
+			opts:      []QueueOption{WithQuorum(), WithDeliveryLimit(5)},
+			want:      amqp.Table{"x-queue-type": "quorum", "x-delivery-limit": int64(5)},
+		},
+		{
+			name:      "bounded classic queue",
+			queueType: DurableQueue,
+			opts: []QueueOption{
+				WithMessageTTL(90 * time.Second),
+				WithMaxLength(100, OverflowRejectPublishDLX),
+				WithSingleActiveConsumer(),
+				WithLazyMode(),
+				WithQueueArg("x-max-priority", 10),
+			},
+			want: amqp.Table{
+				"x-message-ttl":            int64(90000),
+				"x-max-length":             int64(100),
+				"x-overflow":               "reject-publish-dlx",
+				"x-single-active-consumer": true,
+				"x-queue-mode":             "lazy",
+				"x-max-priority":           10,
+			},
+		},
+		{
+			name:      "transient quorum queue",
+			queueType: TransientQueue,
+			opts:      []QueueOption{WithQuorum()},
+			wantErr:   true,
+		},
+		{
+			name:      "lazy quorum queue",
+			queueType: DurableQueue,
+			opts:      []QueueOption{WithQuorum(), WithLazyMode()},
+			wantErr:   true,
+		},
+		{
+			name:      "delivery limit on a classic queue",
+			queueType: DurableQueue,
+			opts:      []QueueOption{WithDeliveryLimit(5)},
+			wantErr:   true,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			o, err := newQueueOptions(tt.queueType, tt.opts)
+			if tt.wantErr {
+				if err == nil {
+					t.Fatalf("got args %v, want an error", o.args)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			// Every queue dead-letters to the game's dead letter exchange.
+			tt.want["x-dead-letter-exchange"] = routing.ExchangePerilDeadLetter
+			if !reflect.DeepEqual(o.args, tt.want) {
+				t.Errorf("got args %v, want %v", o.args, tt.want)
+			}
+		})
+	}
+}
+
+func TestDeclareAndBindWithQueueOptions(t *testing.T) {
+	b := newTestBroker(t)
+	ch, _, err := DeclareAndBind(b, routing.ExchangePerilTopic, "war.alice", "war.alice", DurableQueue, WithQuorum())
+	if err != nil {
+		t.Fatal(err)
+	}
+	ch.Close()
+
+	// Declaring it again with other arguments is refused, as RabbitMQ
+	// would.
+	_, _, err = DeclareAndBind(b, routing.ExchangePerilTopic, "war.alice", "war.alice", DurableQueue)
+	var amqpErr *amqp.Error
+	if !errors.As(err, &amqpErr) || amqpErr.Code != amqp.PreconditionFailed {
+		t.Errorf("got %v, want PRECONDITION_FAILED", err)
+	}
+
+	if _, _, err := DeclareAndBind(b, routing.ExchangePerilTopic, "moves", "moves", TransientQueue, WithQuorum()); err == nil {
+		t.Error("declared a transient quorum queue")
+	}
+}
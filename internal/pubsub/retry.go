@@ -0,0 +1,146 @@
+package pubsub
+
+import (
+	"context"
+	"fmt"
+	"time"
+
+	amqp "github.com/rabbitmq/amqp091-go"
+)
+
+const HeaderRetryAttempt = "x-retry-attempt"
+
+// RetryPolicy delays redelivery of messages whose handler returned
+// NackRequeue. Each failed message is parked in a retry queue whose TTL is
+// the delay for that attempt; when it expires the broker dead-letters it
+// back onto the subscription's queue. Once MaxAttempts handler calls have
+// failed the message goes to the dead letter queue instead.
+//
+// Retries go back through the default exchange to the queue itself, not
+// through the exchange the message was first published to, so that other
+// queues bound to the same key don't get a second copy. A retried delivery
+// therefore has an empty Exchange and the queue's name as its RoutingKey,
+// in Metadata too. The original exchange and routing key are kept in the
+// x-original-exchange and x-original-routing-key headers, which ordered
+// keys, signature checks and dead-letter replays go by.
+type RetryPolicy struct {
+	// Delays[n] is the wait before retry n+1. The last delay is reused for
+	// any further retries.
+	Delays      []time.Duration
+	MaxAttempts int
+}
+
+// ExponentialRetry doubles the delay after every failed attempt, starting
+// at initial.
+func ExponentialRetry(initial time.Duration, maxAttempts int) RetryPolicy {
+	delays := []time.Duration{}
+	d := initial
+	for i := 1; i < maxAttempts; i++ {
+		delays = append(delays, d)
+		d *= 2
+	}
+	return RetryPolicy{Delays: delays, MaxAttempts: maxAttempts}
+}
+
+func WithRetry(p RetryPolicy) SubscribeOption {
+	return func(o *subscribeOptions) {
+		o.retry = &p
+	}
+}
+
+func (p RetryPolicy) delay(attempt int) time.Duration {
+	if len(p.Delays) == 0 {
+		return 0
+	}
+	if attempt >= len(p.Delays) {
+		return p.Delays[len(p.Delays)-1]
+	}
+	return p.Delays[attempt]
+}
+
+func retryQueueName(queueName string, delay time.Duration) string {
+	return fmt.Sprintf("%s.retry.%s", queueName, delay)
+}
+
+// declareRetryQueues declares one retry queue per distinct delay. Expired
+// messages are dead-lettered through the default exchange straight to
+// queueName rather than through the original exchange, so queues that share
+// the original binding key don't receive the retry as well.
+func (p RetryPolicy) declareRetryQueues(ch Channel, queueName string, queueType simpleQueueType) error {
+	seen := map[time.Duration]bool{}
+	for _, delay := range p.Delays {
+		if seen[delay] {
+			continue
+		}
+		seen[delay] = true
+		args := amqp.Table{
+			"x-message-ttl":             delay.Milliseconds(),
+			"x-dead-letter-exchange":    "",
+			"x-dead-letter-routing-key": queueName,
+		}
+		if queueType == TransientQueue {
+			args["x-expires"] = (delay + time.Minute).Milliseconds()
+		}
+		_, err := ch.QueueDeclare(
+			retryQueueName(queueName, delay),
+			queueType == DurableQueue,
+			false,
+			false,
+			false,
+			args,
+		)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func retryAttempt(d amqp.Delivery) int {
+	n, _ := tableInt(d.Headers[HeaderRetryAttempt])
+	return int(n)
+}
+
+// retry parks d in the retry queue for its next attempt, or dead-letters it
+// when the policy is exhausted.
+func (p RetryPolicy) retry(ctx context.Context, ch Publisher, queueName string, d amqp.Delivery) {
+	attempt := retryAttempt(d)
+	if attempt+1 >= p.MaxAttempts || len(p.Delays) == 0 {
+		deadLetter(ctx, ch, d, amqp.Table{HeaderRetryAttempt: int64(attempt)})
+		return
+	}
+	pub := publishingFrom(d)
+	pub.Headers[HeaderRetryAttempt] = int64(attempt + 1)
+	if _, ok := pub.Headers[HeaderOriginalExchange]; !ok {
+		pub.Headers[HeaderOriginalExchange] = d.Exchange
+		pub.Headers[HeaderOriginalRoutingKey] = d.RoutingKey
+	}
+	err := ch.PublishWithContext(
+		ctx,
+		"",
+		retryQueueName(queueName, p.delay(attempt)),
+		false,
+		false,
+		pub,
+	)
+	if err != nil {
+		d.Nack(false, true)
+		return
+	}
+	d.Ack(false)
+}
+
+func tableInt(v any) (int64, bool) {
+	switch n := v.(type) {
+	case int:
+		return int64(n), true
+	case int16:
+		return int64(n), true
+	case int32:
+		return int64(n), true
+	case int64:
+		return n, true
+	default:
+		return 0, false
+	}
+}
@@ -0,0 +1,86 @@
+package pubsub
+
+import (
+	"context"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/bootdotdev/learn-pub-sub-starter/internal/routing"
+)
+
+func TestExponentialRetry(t *testing.T) {
+	p := ExponentialRetry(100*time.Millisecond, 4)
+	want := []time.Duration{100 * time.Millisecond, 200 * time.Millisecond, 400 * time.Millisecond}
+	if len(p.Delays) != len(want) {
+		t.Fatalf("got delays %v, want %v", p.Delays, want)
+	}
+	for i, d := range want {
+		if p.Delays[i] != d {
+			t.Errorf("delay %d is %v, want %v", i, p.Delays[i], d)
+		}
+	}
+	// Attempts past the last delay reuse it.
+	if d := p.delay(10); d != 400*time.Millisecond {
+		t.Errorf("delay(10) = %v, want 400ms", d)
+	}
+}
+
+func TestRetry(t *testing.T) {
+	tests := []struct {
+		name        string
+		failures    int32
+		maxAttempts int
+		wantCalls   int32
+		wantDead    bool
+	}{
+		{"succeeds first time", 0, 3, 1, false},
+		{"succeeds on retry", 2, 3, 3, false},
+		{"runs out of attempts", 5, 3, 3, true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			b := newTestBroker(t)
+			var calls atomic.Int32
+			done := make(chan struct{})
+			sub, err := Subscribe(context.Background(), b, routing.ExchangePerilTopic, routing.GameLogSlug, routing.GameLogSlug+".*", DurableQueue,
+				func(gl routing.GameLog) SimpleAckType {
+					n := calls.Add(1)
+					if n <= tt.failures {
+						if int(n) == tt.maxAttempts {
+							close(done)
+						}
+						return NackRequeue
+					}
+					close(done)
+					return Ack
+				},
+				WithRetry(RetryPolicy{Delays: []time.Duration{5 * time.Millisecond, 10 * time.Millisecond}, MaxAttempts: tt.maxAttempts}),
+			)
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer sub.Close()
+			err = Publish(context.Background(), testChannel(t, b), routing.ExchangePerilTopic, "game_logs.alice", routing.GameLog{Username: "alice"})
+			if err != nil {
+				t.Fatal(err)
+			}
+			select {
+			case <-done:
+			case <-time.After(time.Second):
+				t.Fatalf("handler called %d times, never finished", calls.Load())
+			}
+			if tt.wantDead {
+				waitFor(t, "message to be dead-lettered", func() bool { return b.QueueLen(routing.DeadLetterQueue) == 1 })
+			}
+			// Nothing else should turn up.
+			time.Sleep(30 * time.Millisecond)
+			if n := calls.Load(); n != tt.wantCalls {
+				t.Errorf("handler called %d times, want %d", n, tt.wantCalls)
+			}
+			if !tt.wantDead && b.QueueLen(routing.DeadLetterQueue) != 0 {
+				t.Error("message was dead-lettered")
+			}
+		})
+	}
+}
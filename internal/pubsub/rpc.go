@@ -0,0 +1,244 @@
+package pubsub
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"sync"
+	"time"
+
+	amqp "github.com/rabbitmq/amqp091-go"
+)
+
+// DirectReplyTo is RabbitMQ's pseudo-queue for replies that go straight
+// back to the channel that sent the request.
+const DirectReplyTo = "amq.rabbitmq.reply-to"
+
+// HeaderRPCError carries the error a Serve handler returned instead of a
+// reply.
+const HeaderRPCError = "x-rpc-error"
+
+var ErrCallerClosed = errors.New("rpc caller closed")
+
+// RemoteError is an error returned by the handler on the other end of a
+// Call.
+type RemoteError struct {
+	Msg string
+}
+
+func (e *RemoteError) Error() string {
+	return "remote: " + e.Msg
+}
+
+// Caller sends requests and routes their replies back to the waiting Call.
+// Replies use direct reply-to, so they must arrive on the channel the
+// request was published on; the Caller owns that channel and reopens it if
+// it goes away.
+type Caller struct {
+	conn     Subscriber
+	verifier Verifier
+	sender   string
+	mu       sync.Mutex
+	ch       Channel
+	pending  map[string]chan amqp.Delivery
+	closed   bool
+}
+
+type CallerOption func(*Caller)
+
+// WithReplyVerifier rejects replies that aren't signed by sender's key, as
+// checked by v.
+func WithReplyVerifier(v Verifier, sender string) CallerOption {
+	return func(c *Caller) {
+		c.verifier = v
+		c.sender = sender
+	}
+}
+
+func NewCaller(conn Subscriber, opts ...CallerOption) (*Caller, error) {
+	c := &Caller{
+		conn:    conn,
+		pending: map[string]chan amqp.Delivery{},
+	}
+	for _, opt := range opts {
+		opt(c)
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	_, err := c.channel()
+	if err != nil {
+		return nil, err
+	}
+	return c, nil
+}
+
+// channel must be called with c.mu held.
+func (c *Caller) channel() (Channel, error) {
+	if c.closed {
+		return nil, ErrCallerClosed
+	}
+	if c.ch != nil {
+		return c.ch, nil
+	}
+	ch, err := c.conn.Channel()
+	if err != nil {
+		return nil, err
+	}
+	replies, err := ch.Consume(DirectReplyTo, "", true, false, false, false, nil)
+	if err != nil {
+		ch.Close()
+		return nil, err
+	}
+	c.ch = ch
+	go c.receive(ch, replies)
+	return ch, nil
+}
+
+func (c *Caller) receive(ch Channel, replies <-chan amqp.Delivery) {
+	for d := range replies {
+		c.mu.Lock()
+		waiting, ok := c.pending[d.CorrelationId]
+		delete(c.pending, d.CorrelationId)
+		c.mu.Unlock()
+		if ok {
+			waiting <- d
+		}
+	}
+	// The channel is gone, and with it any reply still on its way. Fail the
+	// calls waiting for one and let the next Call open a new channel.
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.ch == ch {
+		c.ch = nil
+	}
+	for id, waiting := range c.pending {
+		close(waiting)
+		delete(c.pending, id)
+	}
+}
+
+func (c *Caller) Close() error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.closed = true
+	if c.ch == nil {
+		return nil
+	}
+	return c.ch.Close()
+}
+
+// Call publishes req to exchange with the given routing key and waits for
+// the reply, or until ctx is done.
+func Call[Req, Resp any](ctx context.Context, c *Caller, exchange, key string, req Req, opts ...PublishOption) (Resp, error) {
+	var resp Resp
+	msg, err := newPublishing(ctx, req, opts)
+	if err != nil {
+		return resp, err
+	}
+	msg.ReplyTo = DirectReplyTo
+	msg.CorrelationId = msg.MessageId
+	reply := make(chan amqp.Delivery, 1)
+	c.mu.Lock()
+	ch, err := c.channel()
+	if err == nil {
+		c.pending[msg.CorrelationId] = reply
+		err = ch.PublishWithContext(ctx, exchange, key, false, false, msg)
+		if err != nil {
+			delete(c.pending, msg.CorrelationId)
+		}
+	}
+	c.mu.Unlock()
+	if err != nil {
+		return resp, err
+	}
+	select {
+	case d, ok := <-reply:
+		if !ok {
+			return resp, fmt.Errorf("rpc %s: reply channel closed", key)
+		}
+		if c.verifier != nil {
+			keyID, err := verifyDelivery(c.verifier, d, d.RoutingKey)
+			if err == nil && keyID != c.sender {
+				err = fmt.Errorf("reply was signed by %s, not %s", keyID, c.sender)
+			}
+			if err != nil {
+				return resp, fmt.Errorf("rpc %s: unverified reply: %w", key, err)
+			}
+		}
+		if remote, ok := d.Headers[HeaderRPCError].(string); ok {
+			return resp, &RemoteError{Msg: remote}
+		}
+		body, err := decrypt(nil, d, false)
+		if err == nil {
+			body, err = decompress(d.ContentEncoding, body)
+		}
+		if err != nil {
+			return resp, err
+		}
+		return decode[Resp](d.ContentType, body)
+	case <-ctx.Done():
+		c.mu.Lock()
+		delete(c.pending, msg.CorrelationId)
+		c.mu.Unlock()
+		return resp, fmt.Errorf("rpc %s: %w", key, ctx.Err())
+	}
+}
+
+// replyTarget is what Serve needs to answer a request: the delivery, what
+// to publish the reply through and the context to publish it with.
+type replyTarget struct {
+	ctx context.Context
+	ch  Publisher
+	d   amqp.Delivery
+}
+
+type replyTargetKey struct{}
+
+// Serve answers requests arriving on the queue with handler's result,
+// encoded with the same codec as the request. Replies are signed when the
+// subscription has WithSigner. An error from handler is sent
+// back to the caller as a RemoteError. Requests are acked once answered.
+// Servers that should share the work need a DurableQueue: a TransientQueue
+// is exclusive, so only one of them could declare it.
+func Serve[Req, Resp any](
+	ctx context.Context,
+	conn Subscriber,
+	exchange,
+	queueName,
+	key string,
+	queueType simpleQueueType,
+	handler func(context.Context, Req) (Resp, error),
+	opts ...SubscribeOption,
+) (*Subscription, error) {
+	return subscribe(ctx, conn, exchange, queueName, key, queueType, func(ctx context.Context, req Req) SimpleAckType {
+		rt, ok := ctx.Value(replyTargetKey{}).(replyTarget)
+		if !ok || rt.d.ReplyTo == "" {
+			return NackDiscard
+		}
+		d := rt.d
+		codec, ok := CodecFor(d.ContentType)
+		if !ok {
+			codec = JSON
+		}
+		resp, err := handler(ctx, req)
+		var msg amqp.Publishing
+		if err == nil {
+			msg, err = newPublishing(ctx, resp, []PublishOption{WithCodec(codec)})
+		}
+		if err != nil {
+			msg = amqp.Publishing{
+				Headers:   amqp.Table{HeaderRPCError: err.Error()},
+				MessageId: newMessageID(),
+				Timestamp: time.Now(),
+				AppId:     defaultAppID,
+			}
+			injectTrace(ctx, &msg)
+		}
+		msg.CorrelationId = d.CorrelationId
+		err = rt.ch.PublishWithContext(rt.ctx, "", d.ReplyTo, false, false, msg)
+		if err != nil {
+			return NackRequeue
+		}
+		return Ack
+	}, opts)
+}
@@ -0,0 +1,146 @@
+package pubsub
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/bootdotdev/learn-pub-sub-starter/internal/routing"
+)
+
+// serveDouble answers requests on the "double" key with twice their value,
+// or an error for negative ones.
+func serveDouble(t *testing.T, b *MemoryBroker) {
+	t.Helper()
+	sub, err := Serve(context.Background(), b, routing.ExchangePerilDirect, "double", "double", DurableQueue,
+		func(ctx context.Context, n int) (int, error) {
+			if n < 0 {
+				return 0, fmt.Errorf("can't double %d", n)
+			}
+			return 2 * n, nil
+		},
+		WithConcurrency(4),
+	)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { sub.Close() })
+}
+
+func newTestCaller(t *testing.T, b *MemoryBroker) *Caller {
+	t.Helper()
+	c, err := NewCaller(b)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { c.Close() })
+	return c
+}
+
+func TestCallMatchesReplies(t *testing.T) {
+	b := newTestBroker(t)
+	serveDouble(t, b)
+	c := newTestCaller(t, b)
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+	defer cancel()
+
+	var wg sync.WaitGroup
+	for i := 1; i <= 20; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			got, err := Call[int, int](ctx, c, routing.ExchangePerilDirect, "double", i)
+			if err != nil {
+				t.Error(err)
+				return
+			}
+			if got != 2*i {
+				t.Errorf("Call(%d) = %d, want %d", i, got, 2*i)
+			}
+		}()
+	}
+	wg.Wait()
+}
+
+func TestCallRemoteError(t *testing.T) {
+	b := newTestBroker(t)
+	serveDouble(t, b)
+	c := newTestCaller(t, b)
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+	defer cancel()
+	_, err := Call[int, int](ctx, c, routing.ExchangePerilDirect, "double", -1)
+	var remote *RemoteError
+	if !errors.As(err, &remote) || remote.Msg != "can't double -1" {
+		t.Errorf("got %v, want the handler's error", err)
+	}
+}
+
+func TestCallTimeout(t *testing.T) {
+	b := newTestBroker(t)
+	c := newTestCaller(t, b)
+	ctx, cancel := context.WithTimeout(context.Background(), 20*time.Millisecond)
+	defer cancel()
+	// Nothing serves "double", so the request is dropped.
+	_, err := Call[int, int](ctx, c, routing.ExchangePerilDirect, "double", 1)
+	if !errors.Is(err, context.DeadlineExceeded) {
+		t.Errorf("got %v, want DeadlineExceeded", err)
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if len(c.pending) != 0 {
+		t.Errorf("%d calls still waiting after the timeout", len(c.pending))
+	}
+}
+
+func TestCallAfterReplyChannelCloses(t *testing.T) {
+	b := newTestBroker(t)
+	c := newTestCaller(t, b)
+	failed := make(chan error, 1)
+	go func() {
+		_, err := Call[int, int](context.Background(), c, routing.ExchangePerilDirect, "double", 1)
+		failed <- err
+	}()
+	waitFor(t, "call to be sent", func() bool {
+		c.mu.Lock()
+		defer c.mu.Unlock()
+		return len(c.pending) == 1
+	})
+	c.mu.Lock()
+	c.ch.Close()
+	c.mu.Unlock()
+	select {
+	case err := <-failed:
+		if err == nil || !strings.Contains(err.Error(), "reply channel closed") {
+			t.Errorf("got %v, want the reply channel to have closed", err)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("call kept waiting after its channel closed")
+	}
+
+	// The next call opens a new channel.
+	serveDouble(t, b)
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+	defer cancel()
+	waitFor(t, "caller to drop its closed channel", func() bool {
+		c.mu.Lock()
+		defer c.mu.Unlock()
+		return c.ch == nil
+	})
+	if got, err := Call[int, int](ctx, c, routing.ExchangePerilDirect, "double", 2); err != nil || got != 4 {
+		t.Errorf("got %d, %v after reopening, want 4", got, err)
+	}
+}
+
+func TestCallOnClosedCaller(t *testing.T) {
+	b := newTestBroker(t)
+	c := newTestCaller(t, b)
+	c.Close()
+	_, err := Call[int, int](context.Background(), c, routing.ExchangePerilDirect, "double", 1)
+	if !errors.Is(err, ErrCallerClosed) {
+		t.Errorf("got %v, want ErrCallerClosed", err)
+	}
+}
@@ -0,0 +1,196 @@
+package pubsub
+
+import (
+	"context"
+	"crypto/ed25519"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"log/slog"
+	"time"
+
+	amqp "github.com/rabbitmq/amqp091-go"
+)
+
+const (
+	HeaderSignature      = "x-signature"
+	HeaderSignatureKey   = "x-signature-key"
+	HeaderSignatureAlg   = "x-signature-alg"
+	HeaderSignatureError = "x-signature-error"
+)
+
+const (
+	AlgHMACSHA256 = "hmac-sha256"
+	AlgEd25519    = "ed25519"
+)
+
+var ErrUnsigned = errors.New("message is not signed")
+
+// Signer signs message bodies on behalf of one key.
+type Signer interface {
+	KeyID() string
+	Algorithm() string
+	Sign(data []byte) ([]byte, error)
+}
+
+// Verifier checks a signature made by the key with the given ID.
+type Verifier interface {
+	Verify(alg, keyID string, data, sig []byte) error
+}
+
+// Sender is implemented by messages that name who sent them. A verified
+// subscription rejects such a message unless it was signed by that sender's
+// key.
+type Sender interface {
+	Sender() string
+}
+
+type hmacSigner struct {
+	id     string
+	secret []byte
+}
+
+func HMACSigner(keyID string, secret []byte) Signer {
+	return hmacSigner{id: keyID, secret: secret}
+}
+
+func (s hmacSigner) KeyID() string     { return s.id }
+func (s hmacSigner) Algorithm() string { return AlgHMACSHA256 }
+
+func (s hmacSigner) Sign(data []byte) ([]byte, error) {
+	mac := hmac.New(sha256.New, s.secret)
+	mac.Write(data)
+	return mac.Sum(nil), nil
+}
+
+type ed25519Signer struct {
+	id  string
+	key ed25519.PrivateKey
+}
+
+func Ed25519Signer(keyID string, key ed25519.PrivateKey) Signer {
+	return ed25519Signer{id: keyID, key: key}
+}
+
+func (s ed25519Signer) KeyID() string     { return s.id }
+func (s ed25519Signer) Algorithm() string { return AlgEd25519 }
+
+func (s ed25519Signer) Sign(data []byte) ([]byte, error) {
+	return ed25519.Sign(s.key, data), nil
+}
+
+// signedData is what a signature covers: the routing key, the properties
+// that say how to read the body and which message this is, and the body as
+// published. A signed message can't be replayed under another key or have
+// its body reinterpreted. Timestamps only survive AMQP to the second.
+func signedData(key, messageID, correlationID string, ts time.Time, contentType, contentEncoding string, body []byte) []byte {
+	var unix int64
+	if !ts.IsZero() {
+		unix = ts.Unix()
+	}
+	head := fmt.Sprintf("%s\n%s\n%s\n%d\n%s\n%s\n", key, messageID, correlationID, unix, contentType, contentEncoding)
+	return append([]byte(head), body...)
+}
+
+// SigningPublisher signs everything published through p with s.
+func SigningPublisher(p Publisher, s Signer) Publisher {
+	return signingPublisher{p: p, s: s}
+}
+
+type signingPublisher struct {
+	p Publisher
+	s Signer
+}
+
+func (sp signingPublisher) PublishWithContext(ctx context.Context, exchange, key string, mandatory, immediate bool, msg amqp.Publishing) error {
+	sig, err := sp.s.Sign(signedData(key, msg.MessageId, msg.CorrelationId, msg.Timestamp, msg.ContentType, msg.ContentEncoding, msg.Body))
+	if err != nil {
+		return fmt.Errorf("signing message: %w", err)
+	}
+	headers := amqp.Table{}
+	for k, v := range msg.Headers {
+		headers[k] = v
+	}
+	headers[HeaderSignature] = base64.StdEncoding.EncodeToString(sig)
+	headers[HeaderSignatureKey] = sp.s.KeyID()
+	headers[HeaderSignatureAlg] = sp.s.Algorithm()
+	msg.Headers = headers
+	return sp.p.PublishWithContext(ctx, exchange, key, mandatory, immediate, msg)
+}
+
+// WithVerifier rejects deliveries that are unsigned, fail verification or
+// claim a Sender other than the key that signed them. They are
+// dead-lettered with the reason in HeaderSignatureError.
+func WithVerifier(v Verifier) SubscribeOption {
+	return func(o *subscribeOptions) {
+		o.verifier = v
+	}
+}
+
+// WithSigner signs what the subscription sends back to publishers: Serve's
+// replies.
+func WithSigner(s Signer) SubscribeOption {
+	return func(o *subscribeOptions) {
+		o.signer = s
+	}
+}
+
+// verifyDelivery checks d's signature and returns the ID of the key that
+// made it. binding is the key the subscription's queue is bound with.
+func verifyDelivery(v Verifier, d amqp.Delivery, binding string) (string, error) {
+	sigText, _ := d.Headers[HeaderSignature].(string)
+	keyID, _ := d.Headers[HeaderSignatureKey].(string)
+	alg, _ := d.Headers[HeaderSignatureAlg].(string)
+	if sigText == "" || keyID == "" {
+		return "", ErrUnsigned
+	}
+	sig, err := base64.StdEncoding.DecodeString(sigText)
+	if err != nil {
+		return "", fmt.Errorf("malformed signature: %w", err)
+	}
+	key, err := signedKey(d, binding)
+	if err != nil {
+		return "", err
+	}
+	err = v.Verify(alg, keyID, signedData(key, d.MessageId, d.CorrelationId, d.Timestamp, d.ContentType, d.ContentEncoding, d.Body), sig)
+	if err != nil {
+		return "", err
+	}
+	return keyID, nil
+}
+
+// signedKey returns the routing key d was signed under. Retries come back
+// through the default exchange, so they were signed under the key they were
+// first published with. That key is only in an unsigned header, so it is
+// only trusted if the subscription could have received it directly.
+func signedKey(d amqp.Delivery, binding string) (string, error) {
+	orig, ok := d.Headers[HeaderOriginalRoutingKey].(string)
+	if !ok || d.Exchange != "" {
+		return d.RoutingKey, nil
+	}
+	if !topicMatch(binding, orig) {
+		return "", fmt.Errorf("original routing key %s does not match binding %s", orig, binding)
+	}
+	return orig, nil
+}
+
+func rejectUnverified(ctx context.Context, ch Publisher, d amqp.Delivery, o subscribeOptions, log *slog.Logger, err error) {
+	log.Warn("dead-lettering unverified delivery", "error", err)
+	if o.metrics != nil {
+		o.metrics.inc(metricSignatureErrors, o.labels)
+	}
+	deadLetter(ctx, ch, d, amqp.Table{HeaderSignatureError: err.Error()})
+}
+
+func checkSender(keyID string, val any) error {
+	s, ok := val.(Sender)
+	if !ok {
+		return nil
+	}
+	if s.Sender() != keyID {
+		return fmt.Errorf("message claims to be from %s but was signed by %s", s.Sender(), keyID)
+	}
+	return nil
+}
@@ -0,0 +1,222 @@
+package pubsub
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/bootdotdev/learn-pub-sub-starter/internal/routing"
+	amqp "github.com/rabbitmq/amqp091-go"
+)
+
+func testKeyring() *Keyring {
+	k := NewKeyring()
+	k.AddHMAC("alice", []byte("alice secret"))
+	k.AddHMAC(routing.ServerKeyID, []byte("server secret"))
+	return k
+}
+
+// signedDelivery publishes msg through a SigningPublisher and returns what
+// a subscriber bound to exchange would receive.
+func signedDelivery(t *testing.T, s Signer, exchange, key string, msg amqp.Publishing) amqp.Delivery {
+	t.Helper()
+	var sent amqp.Publishing
+	p := SigningPublisher(publisherFunc(func(_ context.Context, _, _ string, _, _ bool, msg amqp.Publishing) error {
+		sent = msg
+		return nil
+	}), s)
+	err := p.PublishWithContext(context.Background(), exchange, key, false, false, msg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return amqp.Delivery{
+		Headers:         sent.Headers,
+		ContentType:     sent.ContentType,
+		ContentEncoding: sent.ContentEncoding,
+		CorrelationId:   sent.CorrelationId,
+		MessageId:       sent.MessageId,
+		Timestamp:       sent.Timestamp,
+		Exchange:        exchange,
+		RoutingKey:      key,
+		Body:            sent.Body,
+	}
+}
+
+func TestVerifyDelivery(t *testing.T) {
+	keys := testKeyring()
+	alice, _ := keys.Signer("alice")
+	msg := amqp.Publishing{
+		ContentType: "application/json",
+		MessageId:   "m1",
+		Timestamp:   time.Now(),
+		Body:        []byte(`{"n":1}`),
+	}
+	tests := []struct {
+		name    string
+		tamper  func(d *amqp.Delivery)
+		wantErr bool
+	}{
+		{"untouched", func(d *amqp.Delivery) {}, false},
+		{"body", func(d *amqp.Delivery) { d.Body = []byte(`{"n":2}`) }, true},
+		{"routing key", func(d *amqp.Delivery) { d.RoutingKey = "game_logs.bob" }, true},
+		{"message id", func(d *amqp.Delivery) { d.MessageId = "m2" }, true},
+		{"correlation id", func(d *amqp.Delivery) { d.CorrelationId = "c1" }, true},
+		{"timestamp", func(d *amqp.Delivery) { d.Timestamp = d.Timestamp.Add(time.Hour) }, true},
+		{"content type", func(d *amqp.Delivery) { d.ContentType = "application/gob" }, true},
+		{"content encoding", func(d *amqp.Delivery) { d.ContentEncoding = "gzip" }, true},
+		{"key id", func(d *amqp.Delivery) { d.Headers[HeaderSignatureKey] = routing.ServerKeyID }, true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			d := signedDelivery(t, alice, routing.ExchangePerilTopic, "game_logs.alice", msg)
+			tt.tamper(&d)
+			keyID, err := verifyDelivery(keys, d, "game_logs.*")
+			if tt.wantErr {
+				if err == nil {
+					t.Fatal("tampered delivery verified")
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			if keyID != "alice" {
+				t.Errorf("signed by %s, want alice", keyID)
+			}
+		})
+	}
+}
+
+func TestVerifyUnsigned(t *testing.T) {
+	_, err := verifyDelivery(testKeyring(), amqp.Delivery{RoutingKey: "k", Body: []byte("{}")}, "k")
+	if !errors.Is(err, ErrUnsigned) {
+		t.Fatalf("got %v, want ErrUnsigned", err)
+	}
+}
+
+// Retries arrive through the default exchange with the original routing key
+// in an unsigned header, which must not let a message signed for one key be
+// delivered to a queue that would never have received it.
+func TestVerifyRetriedDelivery(t *testing.T) {
+	keys := testKeyring()
+	alice, _ := keys.Signer("alice")
+	tests := []struct {
+		name     string
+		origKey  string
+		headerTo string
+		binding  string
+		wantErr  bool
+	}{
+		{"matching binding", "game_logs.alice", "game_logs.alice", "game_logs.*", false},
+		{"header rewritten", "game_logs.alice", "game_logs.bob", "game_logs.*", true},
+		{"binding doesn't match", "army_moves.alice", "army_moves.alice", "game_logs.*", true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			d := signedDelivery(t, alice, routing.ExchangePerilTopic, tt.origKey, amqp.Publishing{
+				MessageId: "m1",
+				Body:      []byte("{}"),
+			})
+			d.Exchange = ""
+			d.RoutingKey = "game_logs"
+			d.Headers[HeaderOriginalExchange] = routing.ExchangePerilTopic
+			d.Headers[HeaderOriginalRoutingKey] = tt.headerTo
+			_, err := verifyDelivery(keys, d, tt.binding)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("got error %v, want error: %v", err, tt.wantErr)
+			}
+		})
+	}
+}
+
+func TestSignedSubscription(t *testing.T) {
+	b := newTestBroker(t)
+	keys := testKeyring()
+	alice, _ := keys.Signer("alice")
+	got := make(chan routing.GameLog, 1)
+	sub, err := SubscribeContext(context.Background(), b, routing.ExchangePerilTopic, routing.GameLogSlug, routing.GameLogSlug+".*", DurableQueue,
+		func(ctx context.Context, gl routing.GameLog) SimpleAckType {
+			got <- gl
+			return Ack
+		},
+		WithVerifier(keys),
+	)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer sub.Close()
+
+	pub := testChannel(t, b)
+	// Signed by someone other than the player the log names.
+	err = Publish(context.Background(), SigningPublisher(pub, alice), routing.ExchangePerilTopic, "game_logs.bob", routing.GameLog{Username: "bob", Message: "hi"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	waitFor(t, "impostor to be dead-lettered", func() bool { return b.QueueLen(routing.DeadLetterQueue) == 1 })
+
+	err = Publish(context.Background(), SigningPublisher(pub, alice), routing.ExchangePerilTopic, "game_logs.alice", routing.GameLog{Username: "alice", Message: "hi"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	select {
+	case gl := <-got:
+		if gl.Username != "alice" {
+			t.Errorf("handled log from %s, want alice", gl.Username)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("signed log was not handled")
+	}
+}
+
+func TestServeSignsReplies(t *testing.T) {
+	b := newTestBroker(t)
+	keys := testKeyring()
+	server, _ := keys.Signer(routing.ServerKeyID)
+	alice, _ := keys.Signer("alice")
+	serve := func(t *testing.T, s Signer) {
+		sub, err := Serve(context.Background(), b, routing.ExchangePerilDirect, routing.PauseStateKey, routing.PauseStateKey, DurableQueue,
+			func(ctx context.Context, req routing.PauseStateRequest) (routing.PlayingState, error) {
+				return routing.PlayingState{IsPaused: true}, nil
+			},
+			WithSigner(s),
+		)
+		if err != nil {
+			t.Fatal(err)
+		}
+		t.Cleanup(func() { sub.Close() })
+	}
+	call := func(t *testing.T) error {
+		caller, err := NewCaller(b, WithReplyVerifier(keys, routing.ServerKeyID))
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer caller.Close()
+		ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+		defer cancel()
+		state, err := Call[routing.PauseStateRequest, routing.PlayingState](ctx, caller, routing.ExchangePerilDirect, routing.PauseStateKey, routing.PauseStateRequest{Username: "alice"})
+		if err == nil && !state.IsPaused {
+			t.Error("got unpaused state")
+		}
+		return err
+	}
+
+	t.Run("signed by server", func(t *testing.T) {
+		serve(t, server)
+		if err := call(t); err != nil {
+			t.Fatal(err)
+		}
+	})
+	t.Run("signed by someone else", func(t *testing.T) {
+		serve(t, alice)
+		if err := call(t); err == nil {
+			t.Fatal("accepted reply signed by alice")
+		}
+	})
+	t.Run("unsigned", func(t *testing.T) {
+		serve(t, nil)
+		if err := call(t); !errors.Is(err, ErrUnsigned) {
+			t.Fatalf("got %v, want ErrUnsigned", err)
+		}
+	})
+}
@@ -0,0 +1,465 @@
+package pubsub
+
+import (
+	"context"
+	"fmt"
+	"hash/fnv"
+	"log/slog"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	amqp "github.com/rabbitmq/amqp091-go"
+)
+
+const (
+	resubscribeDelay = time.Second
+	// settleGrace is how long retries, dead letters and replies of handler
+	// calls still running at Close may wait for the broker.
+	settleGrace = 5 * time.Second
+)
+
+var consumerSeq atomic.Uint64
+
+// Subscription is a running consumer started by one of the Subscribe
+// functions. It stops when its context is cancelled or Close is called.
+type Subscription struct {
+	cancel context.CancelFunc
+	done   chan struct{}
+	err    error
+}
+
+// Close cancels the consumer, waits for the handler calls in progress to
+// finish and closes the channel the subscription owns. Deliveries that were
+// not handled yet are requeued by the broker.
+func (s *Subscription) Close() error {
+	s.cancel()
+	return s.Wait()
+}
+
+// Wait blocks until the subscription has stopped. It returns nil once the
+// subscription was closed or its context cancelled, and an error if the
+// broker or the connection closed it first.
+func (s *Subscription) Wait() error {
+	<-s.done
+	return s.err
+}
+
+type SubscribeOption func(*subscribeOptions)
+
+type subscribeOptions struct {
+	prefetch      int
+	prefetchSet   bool
+	concurrency   int
+	orderedKeys   bool
+	onDecodeError func(amqp.Delivery, error)
+	retry         *RetryPolicy
+	middleware    []Middleware
+	logger        *slog.Logger
+	metrics       *Metrics
+	labels        metricLabels
+	dedup         DedupStore
+	queue         []QueueOption
+	verifier      Verifier
+	signer        Signer
+	decryption    KeySource
+	validate      bool
+	schema        *JSONSchema
+}
+
+// WithPrefetch sets how many unacked deliveries the broker will hand the
+// subscription at once. Zero means no limit. The default is 10, or the
+// number of workers when WithConcurrency is used.
+func WithPrefetch(n int) SubscribeOption {
+	return func(o *subscribeOptions) {
+		o.prefetch = n
+		o.prefetchSet = true
+	}
+}
+
+// WithConcurrency runs n handler calls at once. The handler must be safe
+// for concurrent use.
+func WithConcurrency(n int) SubscribeOption {
+	return func(o *subscribeOptions) {
+		o.concurrency = n
+	}
+}
+
+// WithOrderedKeys keeps deliveries with the same routing key in order when
+// running more than one worker.
+func WithOrderedKeys() SubscribeOption {
+	return func(o *subscribeOptions) {
+		o.orderedKeys = true
+	}
+}
+
+// WithDecodeErrorHandler registers a callback for deliveries that could not
+// be decoded. It runs after the delivery has been dead-lettered.
+func WithDecodeErrorHandler(fn func(d amqp.Delivery, err error)) SubscribeOption {
+	return func(o *subscribeOptions) {
+		o.onDecodeError = fn
+	}
+}
+
+// outlet is what a subscription publishes retries, dead letters and replies
+// through. They come from every worker at once, so they don't go out on the
+// consumer's channel.
+type outlet struct {
+	ctx context.Context
+	pub Publisher
+}
+
+type consumer struct {
+	ch     Channel
+	queue  string
+	key    string
+	tag    string
+	msgs   <-chan amqp.Delivery
+	closed chan *amqp.Error
+}
+
+// closeNotifier reports why the broker closed a channel, as *amqp.Channel
+// does.
+type closeNotifier interface {
+	NotifyClose(c chan *amqp.Error) chan *amqp.Error
+}
+
+// closeErr is why the consumer's channel went away: the broker's reason if
+// it gave one, or else amqp.ErrClosed.
+func (c consumer) closeErr() error {
+	select {
+	case err, ok := <-c.closed:
+		if ok && err != nil {
+			return err
+		}
+	default:
+	}
+	return amqp.ErrClosed
+}
+
+func subscribe[T any](
+	ctx context.Context,
+	conn Subscriber,
+	exchange,
+	queueName,
+	key string,
+	queueType simpleQueueType,
+	handler func(context.Context, T) SimpleAckType,
+	opts []SubscribeOption,
+) (*Subscription, error) {
+	o := subscribeOptions{prefetch: 10, concurrency: 1}
+	for _, opt := range opts {
+		opt(&o)
+	}
+	if !o.prefetchSet && o.concurrency > 1 {
+		o.prefetch = o.concurrency
+	}
+	var zero T
+	o.labels = metricLabels{exchange: exchange, queue: queueName, typ: fmt.Sprintf("%T", zero)}
+	if o.logger == nil {
+		o.logger = silentLogger
+		if lp, ok := conn.(loggerProvider); ok {
+			o.logger = lp.logger()
+		}
+	}
+	h := chain(o.middleware, func(ctx context.Context, msg Message) SimpleAckType {
+		return handler(ctx, msg.Value.(T))
+	})
+	ctx, cancel := context.WithCancel(ctx)
+	c, err := consume(ctx, conn, exchange, queueName, key, queueType, o)
+	if err != nil {
+		cancel()
+		return nil, err
+	}
+	sub := &Subscription{
+		cancel: cancel,
+		done:   make(chan struct{}),
+	}
+	// Handlers get a context that outlives Close so that calls in flight
+	// can finish.
+	hctx := context.WithoutCancel(ctx)
+	out := outlet{pub: publisherFor(conn, o.concurrency)}
+	var outCancel context.CancelFunc
+	out.ctx, outCancel = context.WithCancel(hctx)
+	context.AfterFunc(ctx, func() {
+		time.AfterFunc(settleGrace, outCancel)
+	})
+	go func() {
+		defer close(sub.done)
+		if pool, ok := out.pub.(*PublisherPool); ok {
+			defer pool.Close()
+		}
+		for {
+			cur := c
+			stop := context.AfterFunc(ctx, func() {
+				cur.ch.Cancel(cur.tag, false)
+			})
+			dispatch(ctx, c.msgs, o, func(d amqp.Delivery) {
+				handleDelivery[T](hctx, cur, out, d, h, o)
+			})
+			stop()
+			if ctx.Err() != nil {
+				sub.err = c.ch.Close()
+				return
+			}
+			c.ch.Close()
+			// The deliveries channel only closes on its own when the AMQP
+			// channel goes away. A managed connection will come back, so
+			// start consuming again once it does.
+			rc, ok := conn.(reconnector)
+			if !ok {
+				sub.err = c.closeErr()
+				return
+			}
+			for {
+				if rc.isClosed() {
+					sub.err = amqp.ErrClosed
+					return
+				}
+				c, err = consume(ctx, conn, exchange, queueName, key, queueType, o)
+				if err == nil {
+					break
+				}
+				select {
+				case <-ctx.Done():
+					return
+				case <-time.After(resubscribeDelay):
+				}
+			}
+		}
+	}()
+	return sub, nil
+}
+
+// dispatch feeds deliveries to the subscription's workers until msgs closes
+// or ctx is cancelled, then waits for the workers to finish what they were
+// given. With ordered keys each routing key always goes to the same worker,
+// retries included, so messages sharing a key are handled one at a time in
+// the order they arrived.
+func dispatch(ctx context.Context, msgs <-chan amqp.Delivery, o subscribeOptions, handle func(amqp.Delivery)) {
+	workers := o.concurrency
+	if workers < 1 {
+		workers = 1
+	}
+	queues := make([]chan amqp.Delivery, 1)
+	if o.orderedKeys {
+		queues = make([]chan amqp.Delivery, workers)
+	}
+	for i := range queues {
+		queues[i] = make(chan amqp.Delivery)
+	}
+	var wg sync.WaitGroup
+	for i := 0; i < workers; i++ {
+		wg.Add(1)
+		go func(q chan amqp.Delivery) {
+			defer wg.Done()
+			for d := range q {
+				handle(d)
+			}
+		}(queues[i%len(queues)])
+	}
+	for d := range msgs {
+		if ctx.Err() != nil {
+			break
+		}
+		queues[keyWorker(d, len(queues))] <- d
+	}
+	for _, q := range queues {
+		close(q)
+	}
+	wg.Wait()
+}
+
+// keyWorker picks which of n workers handles d by hashing its routing key.
+// Retries come back through the default exchange under the retry queue's
+// name, so for them it hashes the key they were first published with.
+func keyWorker(d amqp.Delivery, n int) int {
+	if n <= 1 {
+		return 0
+	}
+	key := d.RoutingKey
+	if orig, ok := d.Headers[HeaderOriginalRoutingKey].(string); ok && d.Exchange == "" {
+		key = orig
+	}
+	h := fnv.New32a()
+	h.Write([]byte(key))
+	return int(h.Sum32() % uint32(n))
+}
+
+// publisherFor returns conn if it can publish from many goroutines, as Conn
+// can, or else a pool of channels on it.
+func publisherFor(conn Subscriber, workers int) Publisher {
+	if p, ok := conn.(Publisher); ok {
+		return p
+	}
+	return NewPublisherPool(conn, max(workers, 1))
+}
+
+func handleDelivery[T any](ctx context.Context, c consumer, out outlet, d amqp.Delivery, h HandlerFunc, o subscribeOptions) {
+	log := o.logger.With(deliveryAttrs(c.queue, d)...)
+	dedup := o.dedup != nil && d.MessageId != ""
+	marked := false
+	if dedup {
+		claimed, err := o.dedup.Claim(ctx, d.MessageId)
+		if err != nil {
+			log.Warn("error checking dedup store", "error", err)
+			d.Nack(false, true)
+			return
+		}
+		if !claimed {
+			d.Ack(false)
+			log.Debug("acked duplicate delivery")
+			return
+		}
+		// Unless the handler acks, the claim is given back so the message
+		// can be handled if it comes back.
+		defer func() {
+			if !marked {
+				o.dedup.Release(d.MessageId)
+			}
+		}()
+	}
+	var signer string
+	if o.verifier != nil {
+		var err error
+		signer, err = verifyDelivery(o.verifier, d, c.key)
+		if err != nil {
+			rejectUnverified(out.ctx, out.pub, d, o, log, err)
+			return
+		}
+	}
+	body, err := decrypt(o.decryption, d, o.decryption != nil)
+	if err == nil {
+		body, err = decompress(d.ContentEncoding, body)
+	}
+	var val T
+	if err == nil {
+		if o.schema != nil {
+			if err := checkSchema(o.schema, d.ContentType, body); err != nil {
+				rejectInvalid(out.ctx, out.pub, d, o, log, err)
+				return
+			}
+		}
+		val, err = decode[T](d.ContentType, body)
+	}
+	if err != nil {
+		log.Warn("dead-lettering undecodable delivery", "content_type", d.ContentType, "error", err)
+		if o.metrics != nil {
+			o.metrics.inc(metricDecodeErrors, o.labels)
+		}
+		deadLetter(out.ctx, out.pub, d, amqp.Table{
+			HeaderDecodeError:  err.Error(),
+			HeaderExpectedType: fmt.Sprintf("%T", val),
+		})
+		if o.onDecodeError != nil {
+			o.onDecodeError(d, err)
+		}
+		return
+	}
+	if o.verifier != nil {
+		if err := checkSender(signer, val); err != nil {
+			rejectUnverified(out.ctx, out.pub, d, o, log, err)
+			return
+		}
+	}
+	if o.validate {
+		if err := validateValue(val); err != nil {
+			rejectInvalid(out.ctx, out.pub, d, o, log, err)
+			return
+		}
+	}
+	md := metadataFrom(d)
+	md.SignedBy = signer
+	ctx = extractTrace(ctx, d)
+	ctx = context.WithValue(ctx, metadataKey{}, md)
+	replies := out.pub
+	if o.signer != nil {
+		replies = SigningPublisher(replies, o.signer)
+	}
+	ctx = context.WithValue(ctx, replyTargetKey{}, replyTarget{ctx: out.ctx, ch: replies, d: d})
+	start := time.Now()
+	ack := h(ctx, Message{Delivery: d, Metadata: md, Value: val})
+	if o.metrics != nil {
+		o.metrics.observe(metricHandlerTime, o.labels, time.Since(start))
+		o.metrics.recordAck(o.labels, ack)
+	}
+	// Discarded messages aren't recorded, so they can still be handled if
+	// they are replayed from the dead-letter queue.
+	if dedup && ack == Ack {
+		err := o.dedup.Mark(d.MessageId)
+		if err != nil {
+			log.Warn("error recording delivery in dedup store", "error", err)
+		}
+		marked = err == nil
+	}
+	switch ack {
+	case Ack:
+		d.Ack(false)
+	case NackRequeue:
+		if o.retry != nil {
+			o.retry.retry(out.ctx, out.pub, c.queue, d)
+			log.Debug("handled delivery", "outcome", "retry", "attempt", retryAttempt(d)+1)
+			return
+		}
+		d.Nack(false, true)
+	case NackDiscard:
+		d.Nack(false, false)
+	}
+	log.Debug("handled delivery", "outcome", ack.String())
+}
+
+// consume declares the subscription's queues and starts consuming. It gives
+// up when ctx is done, so a subscription can be closed while the broker is
+// down.
+func consume(
+	ctx context.Context,
+	conn Subscriber,
+	exchange,
+	queueName,
+	key string,
+	queueType simpleQueueType,
+	o subscribeOptions,
+) (consumer, error) {
+	qo, err := newQueueOptions(queueType, o.queue)
+	if err != nil {
+		return consumer{}, err
+	}
+	chann, q, err := declareAndBindContext(ctx, conn, exchange, queueName, key, queueType, qo)
+	if err != nil {
+		return consumer{}, err
+	}
+	if o.retry != nil {
+		err = o.retry.declareRetryQueues(chann, q.Name, queueType)
+		if err != nil {
+			chann.Close()
+			return consumer{}, err
+		}
+	}
+	if o.prefetch > 0 {
+		err = chann.Qos(o.prefetch, 0, false)
+		if err != nil {
+			o.logger.Error("error setting QoS", "queue", q.Name, "error", err)
+			chann.Close()
+			return consumer{}, err
+		}
+	}
+	tag := fmt.Sprintf("%s-%d", q.Name, consumerSeq.Add(1))
+	msgs, err := chann.Consume(
+		q.Name,
+		tag,
+		false,
+		false,
+		false,
+		false,
+		nil,
+	)
+	if err != nil {
+		chann.Close()
+		return consumer{}, err
+	}
+	c := consumer{ch: chann, queue: q.Name, key: key, tag: tag, msgs: msgs}
+	if cn, ok := chann.(closeNotifier); ok {
+		c.closed = cn.NotifyClose(make(chan *amqp.Error, 1))
+	}
+	return c, nil
+}
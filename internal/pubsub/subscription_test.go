@@ -0,0 +1,318 @@
+package pubsub
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/bootdotdev/learn-pub-sub-starter/internal/routing"
+	amqp "github.com/rabbitmq/amqp091-go"
+)
+
+// flakyConn is a managed connection to a memory broker that can be taken
+// down. While it is down, opening a channel waits like Conn does.
+type flakyConn struct {
+	*MemoryBroker
+	mu       sync.Mutex
+	down     bool
+	shut     bool
+	restored chan struct{}
+	channels []Channel
+}
+
+func (c *flakyConn) Channel() (Channel, error) {
+	return c.channel(context.Background())
+}
+
+func (c *flakyConn) channel(ctx context.Context) (Channel, error) {
+	for {
+		c.mu.Lock()
+		down, restored := c.down, c.restored
+		c.mu.Unlock()
+		if !down {
+			break
+		}
+		select {
+		case <-restored:
+		case <-ctx.Done():
+			return nil, ctx.Err()
+		}
+	}
+	ch, err := c.MemoryBroker.Channel()
+	if err == nil {
+		c.mu.Lock()
+		c.channels = append(c.channels, ch)
+		c.mu.Unlock()
+	}
+	return ch, err
+}
+
+func (c *flakyConn) isClosed() bool {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.shut
+}
+
+// drop closes every open channel and keeps new ones from opening.
+func (c *flakyConn) drop() {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.down = true
+	c.restored = make(chan struct{})
+	for _, ch := range c.channels {
+		ch.Close()
+	}
+	c.channels = nil
+}
+
+// restore lets channels open again.
+func (c *flakyConn) restore() {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.down = false
+	close(c.restored)
+}
+
+func TestCloseWhileBrokerDown(t *testing.T) {
+	conn := &flakyConn{MemoryBroker: newTestBroker(t)}
+	sub, err := Subscribe(context.Background(), conn, routing.ExchangePerilTopic, routing.GameLogSlug, routing.GameLogSlug+".*", DurableQueue,
+		func(gl routing.GameLog) SimpleAckType { return Ack },
+	)
+	if err != nil {
+		t.Fatal(err)
+	}
+	conn.drop()
+	// Give the subscription time to start waiting for the connection.
+	time.Sleep(20 * time.Millisecond)
+	closed := make(chan struct{})
+	go func() {
+		sub.Close()
+		close(closed)
+	}()
+	select {
+	case <-closed:
+	case <-time.After(time.Second):
+		t.Fatal("Close blocked while the broker was down")
+	}
+}
+
+func TestWaitReportsBrokerClose(t *testing.T) {
+	tests := []struct {
+		name string
+		// shut closes the connection for good rather than letting it come
+		// back.
+		shut  bool
+		plain bool
+	}{
+		{name: "plain connection", plain: true},
+		{name: "managed connection closed", shut: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			conn := &flakyConn{MemoryBroker: newTestBroker(t)}
+			// Embedding hides flakyConn's reconnecting methods.
+			var sc Subscriber = struct{ Subscriber }{conn}
+			if !tt.plain {
+				sc = conn
+			}
+			sub, err := Subscribe(context.Background(), sc, routing.ExchangePerilTopic, routing.GameLogSlug, routing.GameLogSlug+".*", DurableQueue,
+				func(gl routing.GameLog) SimpleAckType { return Ack },
+			)
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer sub.Close()
+			if tt.shut {
+				conn.mu.Lock()
+				conn.shut = true
+				conn.mu.Unlock()
+			}
+			conn.drop()
+			waited := make(chan error, 1)
+			go func() { waited <- sub.Wait() }()
+			select {
+			case err := <-waited:
+				if !errors.Is(err, amqp.ErrClosed) {
+					t.Errorf("Wait returned %v, want ErrClosed", err)
+				}
+			case <-time.After(time.Second):
+				t.Fatal("subscription didn't stop when its channel closed")
+			}
+		})
+	}
+}
+
+func TestKeyWorkerFollowsRetries(t *testing.T) {
+	for _, player := range []string{"alice", "bob", "carol", "dave"} {
+		key := routing.GameLogSlug + "." + player
+		fresh := amqp.Delivery{Exchange: routing.ExchangePerilTopic, RoutingKey: key}
+		retried := amqp.Delivery{
+			RoutingKey: routing.GameLogSlug,
+			Headers:    amqp.Table{HeaderOriginalRoutingKey: key},
+		}
+		if w, rw := keyWorker(fresh, 4), keyWorker(retried, 4); w != rw {
+			t.Errorf("%s's logs go to worker %d, retried ones to worker %d", player, w, rw)
+		}
+	}
+}
+
+// With ordered keys no player's logs are handled concurrently, even while
+// some of them are being retried.
+func TestOrderedKeysWithRetries(t *testing.T) {
+	b := newTestBroker(t)
+	const players, logs = 4, 8
+	var (
+		mu       sync.Mutex
+		inFlight = map[string]bool{}
+		failed   = map[string]bool{}
+		overlaps int
+		handled  int
+	)
+	done := make(chan struct{})
+	sub, err := Subscribe(context.Background(), b, routing.ExchangePerilTopic, routing.GameLogSlug, routing.GameLogSlug+".*", DurableQueue,
+		func(gl routing.GameLog) SimpleAckType {
+			mu.Lock()
+			if inFlight[gl.Username] {
+				overlaps++
+			}
+			inFlight[gl.Username] = true
+			mu.Unlock()
+			time.Sleep(2 * time.Millisecond)
+			mu.Lock()
+			defer mu.Unlock()
+			inFlight[gl.Username] = false
+			// Each player's first log fails once.
+			if gl.Message == "0" && !failed[gl.Username] {
+				failed[gl.Username] = true
+				return NackRequeue
+			}
+			handled++
+			if handled == players*logs {
+				close(done)
+			}
+			return Ack
+		},
+		WithConcurrency(players),
+		WithOrderedKeys(),
+		WithRetry(RetryPolicy{Delays: []time.Duration{time.Millisecond}, MaxAttempts: 3}),
+	)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer sub.Close()
+	ch := testChannel(t, b)
+	for i := 0; i < logs; i++ {
+		for p := 0; p < players; p++ {
+			user := fmt.Sprintf("player%d", p)
+			err := Publish(context.Background(), ch, routing.ExchangePerilTopic, routing.GameLogSlug+"."+user, routing.GameLog{Username: user, Message: fmt.Sprint(i)})
+			if err != nil {
+				t.Fatal(err)
+			}
+		}
+	}
+	select {
+	case <-done:
+	case <-time.After(2 * time.Second):
+		t.Fatal("not every log was handled")
+	}
+	mu.Lock()
+	defer mu.Unlock()
+	if overlaps != 0 {
+		t.Errorf("a player's logs were handled concurrently %d times", overlaps)
+	}
+}
+
+func TestConcurrencyRunsHandlersInParallel(t *testing.T) {
+	b := newTestBroker(t)
+	const workers = 4
+	started := make(chan struct{}, workers)
+	release := make(chan struct{})
+	sub, err := Subscribe(context.Background(), b, routing.ExchangePerilTopic, routing.GameLogSlug, routing.GameLogSlug+".*", DurableQueue,
+		func(gl routing.GameLog) SimpleAckType {
+			started <- struct{}{}
+			<-release
+			return Ack
+		},
+		WithConcurrency(workers),
+	)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer sub.Close()
+	defer close(release)
+	ch := testChannel(t, b)
+	for range workers {
+		if err := Publish(context.Background(), ch, routing.ExchangePerilTopic, "game_logs.alice", routing.GameLog{}); err != nil {
+			t.Fatal(err)
+		}
+	}
+	for i := range workers {
+		select {
+		case <-started:
+		case <-time.After(time.Second):
+			t.Fatalf("only %d of %d handlers ran at once", i, workers)
+		}
+	}
+}
+
+func TestOrderedKeysKeepOrder(t *testing.T) {
+	b := newTestBroker(t)
+	const players, logs = 4, 10
+	var (
+		mu      sync.Mutex
+		got     = map[string][]string{}
+		handled int
+	)
+	done := make(chan struct{})
+	sub, err := Subscribe(context.Background(), b, routing.ExchangePerilTopic, routing.GameLogSlug, routing.GameLogSlug+".*", DurableQueue,
+		func(gl routing.GameLog) SimpleAckType {
+			// Uneven handling times would let a later log overtake an
+			// earlier one on another worker.
+			time.Sleep(time.Duration(len(gl.Message)%3) * time.Millisecond)
+			mu.Lock()
+			defer mu.Unlock()
+			got[gl.Username] = append(got[gl.Username], gl.Message)
+			handled++
+			if handled == players*logs {
+				close(done)
+			}
+			return Ack
+		},
+		WithConcurrency(players),
+		WithOrderedKeys(),
+	)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer sub.Close()
+	ch := testChannel(t, b)
+	for i := 0; i < logs; i++ {
+		for p := 0; p < players; p++ {
+			user := fmt.Sprintf("player%d", p)
+			msg := strings.Repeat("x", i)
+			err := Publish(context.Background(), ch, routing.ExchangePerilTopic, routing.GameLogSlug+"."+user, routing.GameLog{Username: user, Message: msg})
+			if err != nil {
+				t.Fatal(err)
+			}
+		}
+	}
+	select {
+	case <-done:
+	case <-time.After(2 * time.Second):
+		t.Fatal("not every log was handled")
+	}
+	mu.Lock()
+	defer mu.Unlock()
+	for user, msgs := range got {
+		for i, msg := range msgs {
+			if len(msg) != i {
+				t.Errorf("%s's log %d was handled in position %d", user, len(msg), i)
+				break
+			}
+		}
+	}
+}
@@ -0,0 +1,162 @@
+package pubsub
+
+import (
+	"errors"
+	"fmt"
+
+	"github.com/bootdotdev/learn-pub-sub-starter/internal/routing"
+	amqp "github.com/rabbitmq/amqp091-go"
+)
+
+// DeclareTopology declares every exchange, queue and binding in t, in that
+// order. Declaring something that already exists with the same settings is
+// a no-op, so it is safe to call on every startup. On a Conn the topology
+// is declared again after each reconnect.
+func DeclareTopology(conn Subscriber, t routing.Topology) error {
+	ch, err := conn.Channel()
+	if err != nil {
+		return err
+	}
+	defer ch.Close()
+	r, _ := conn.(topologyRecorder)
+	for _, d := range topologyDeclarations(t) {
+		if err := d.declare(ch); err != nil {
+			return err
+		}
+		if r != nil {
+			r.recordTopology(d.key, d.declare)
+		}
+	}
+	return nil
+}
+
+func topologyDeclarations(t routing.Topology) []declaration {
+	var decls []declaration
+	for _, ex := range t.Exchanges {
+		decls = append(decls, declaration{
+			key: "exchange:" + ex.Name,
+			declare: func(ch Channel) error {
+				err := ch.ExchangeDeclare(ex.Name, ex.Kind, ex.Durable, ex.AutoDelete, ex.Internal, false, amqp.Table(ex.Args))
+				if err != nil {
+					return fmt.Errorf("declaring exchange %s: %w", ex.Name, err)
+				}
+				return nil
+			},
+		})
+	}
+	for _, q := range t.Queues {
+		decls = append(decls, declaration{
+			key: "queue:" + q.Name,
+			declare: func(ch Channel) error {
+				_, err := ch.QueueDeclare(q.Name, q.Durable, q.AutoDelete, false, false, amqp.Table(q.Arguments()))
+				if err != nil {
+					return fmt.Errorf("declaring queue %s: %w", q.Name, err)
+				}
+				return nil
+			},
+		})
+	}
+	for _, b := range t.Bindings {
+		decls = append(decls, declaration{
+			key: "binding:" + b.Queue + ":" + b.Exchange + ":" + b.Key,
+			declare: func(ch Channel) error {
+				err := ch.QueueBind(b.Queue, b.Key, b.Exchange, false, amqp.Table(b.Args))
+				if err != nil {
+					return fmt.Errorf("binding %s to %s: %w", b.Queue, b.Exchange, err)
+				}
+				return nil
+			},
+		})
+	}
+	return decls
+}
+
+// passiveChannel can check whether an exchange or queue exists without
+// creating it.
+type passiveChannel interface {
+	ExchangeDeclarePassive(name, kind string, durable, autoDelete, internal, noWait bool, args amqp.Table) error
+	QueueDeclarePassive(name string, durable, autoDelete, exclusive, noWait bool, args amqp.Table) (amqp.Queue, error)
+}
+
+// TopologyDifference is something in a topology the broker doesn't match.
+type TopologyDifference struct {
+	Kind    string
+	Name    string
+	Problem string
+}
+
+func (d TopologyDifference) String() string {
+	return fmt.Sprintf("%s %s: %s", d.Kind, d.Name, d.Problem)
+}
+
+// DiffTopology reports the exchanges and queues in t that the broker does
+// not have, or has with other settings. Settings are compared by declaring
+// what already exists again, which the broker refuses if they differ. AMQP
+// can't tell what a queue is bound to, so bindings aren't compared.
+func DiffTopology(conn Subscriber, t routing.Topology) ([]TopologyDifference, error) {
+	var diffs []TopologyDifference
+	// A failed declare closes the channel, so every step gets a channel of
+	// its own.
+	check := func(kind, name string, passive func(passiveChannel) error, declare func(Channel) error) error {
+		ch, err := conn.Channel()
+		if err != nil {
+			return err
+		}
+		pc, ok := ch.(passiveChannel)
+		if !ok {
+			ch.Close()
+			return fmt.Errorf("channel %T cannot make passive declarations", ch)
+		}
+		problem := passive(pc)
+		ch.Close()
+		if problem == nil {
+			// It exists, so declaring it can't create anything.
+			ch, err = conn.Channel()
+			if err != nil {
+				return err
+			}
+			problem = declare(ch)
+			ch.Close()
+		}
+		var amqpErr *amqp.Error
+		switch {
+		case problem == nil:
+		case errors.As(problem, &amqpErr) && amqpErr.Code == amqp.NotFound:
+			diffs = append(diffs, TopologyDifference{Kind: kind, Name: name, Problem: "missing"})
+		case errors.As(problem, &amqpErr) && amqpErr.Code == amqp.PreconditionFailed:
+			diffs = append(diffs, TopologyDifference{Kind: kind, Name: name, Problem: "mismatch: " + amqpErr.Reason})
+		default:
+			diffs = append(diffs, TopologyDifference{Kind: kind, Name: name, Problem: problem.Error()})
+		}
+		return nil
+	}
+	for _, ex := range t.Exchanges {
+		err := check("exchange", ex.Name,
+			func(pc passiveChannel) error {
+				return pc.ExchangeDeclarePassive(ex.Name, ex.Kind, ex.Durable, ex.AutoDelete, ex.Internal, false, nil)
+			},
+			func(ch Channel) error {
+				return ch.ExchangeDeclare(ex.Name, ex.Kind, ex.Durable, ex.AutoDelete, ex.Internal, false, amqp.Table(ex.Args))
+			},
+		)
+		if err != nil {
+			return nil, err
+		}
+	}
+	for _, q := range t.Queues {
+		err := check("queue", q.Name,
+			func(pc passiveChannel) error {
+				_, err := pc.QueueDeclarePassive(q.Name, q.Durable, q.AutoDelete, false, false, nil)
+				return err
+			},
+			func(ch Channel) error {
+				_, err := ch.QueueDeclare(q.Name, q.Durable, q.AutoDelete, false, false, amqp.Table(q.Arguments()))
+				return err
+			},
+		)
+		if err != nil {
+			return nil, err
+		}
+	}
+	return diffs, nil
+}
@@ -0,0 +1,120 @@
+package pubsub
+
+import (
+	"context"
+	"strings"
+	"testing"
+
+	"github.com/bootdotdev/learn-pub-sub-starter/internal/routing"
+	amqp "github.com/rabbitmq/amqp091-go"
+)
+
+func TestDiffTopology(t *testing.T) {
+	b := newTestBroker(t)
+	want := routing.PerilTopology()
+	want.Queues = append(want.Queues,
+		routing.Queue{Name: "game_logs", Durable: true, Args: map[string]any{"x-message-ttl": 60000}},
+		routing.Queue{Name: "absent", Durable: true},
+	)
+	want.Exchanges = append(want.Exchanges, routing.Exchange{Name: "audit", Kind: "topic", Durable: true})
+
+	// The broker has game_logs with another TTL and audit as a fanout.
+	ch := testChannel(t, b)
+	_, err := ch.QueueDeclare("game_logs", true, false, false, false, map[string]any{"x-message-ttl": int32(1000)})
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = ch.ExchangeDeclare("audit", "fanout", true, false, false, false, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	diffs, err := DiffTopology(b, want)
+	if err != nil {
+		t.Fatal(err)
+	}
+	got := map[string]string{}
+	for _, d := range diffs {
+		got[d.Kind+" "+d.Name] = d.Problem
+	}
+	tests := []struct {
+		entity  string
+		problem string
+	}{
+		{"queue absent", "missing"},
+		{"queue game_logs", "mismatch"},
+		{"exchange audit", "mismatch"},
+	}
+	for _, tt := range tests {
+		if !strings.HasPrefix(got[tt.entity], tt.problem) {
+			t.Errorf("%s: got problem %q, want %s", tt.entity, got[tt.entity], tt.problem)
+		}
+	}
+	if len(diffs) != len(tests) {
+		t.Errorf("got differences %v, want only %d", diffs, len(tests))
+	}
+}
+
+func TestDeclareTopology(t *testing.T) {
+	b := NewMemoryBroker()
+	conn := &Conn{}
+	rb := recordingBroker{MemoryBroker: b, conn: conn}
+	want := routing.Topology{
+		Exchanges: []routing.Exchange{{Name: "events", Kind: "topic", Durable: true}},
+		Queues: []routing.Queue{
+			{Name: "dead", Durable: true},
+			{Name: "work", Durable: true, DeadLetterExchange: "events", DeadLetterRoutingKey: "dead"},
+		},
+		Bindings: []routing.Binding{
+			{Queue: "work", Exchange: "events", Key: "work.*"},
+			{Queue: "dead", Exchange: "events", Key: "dead"},
+		},
+	}
+	// Declaring again is a no-op, and isn't recorded twice.
+	for range 2 {
+		if err := DeclareTopology(rb, want); err != nil {
+			t.Fatal(err)
+		}
+	}
+	var keys []string
+	for _, d := range conn.topology {
+		keys = append(keys, d.key)
+	}
+	wantKeys := "exchange:events queue:dead queue:work binding:work:events:work.* binding:dead:events:dead"
+	if got := strings.Join(keys, " "); got != wantKeys {
+		t.Errorf("recorded %s, want %s", got, wantKeys)
+	}
+
+	diffs, err := DiffTopology(b, want)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(diffs) != 0 {
+		t.Errorf("declared topology differs: %v", diffs)
+	}
+
+	// The bindings and dead-letter arguments are in place.
+	ch := testChannel(t, b)
+	msgs, err := ch.Consume("work", "", false, false, false, false, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = ch.PublishWithContext(context.Background(), "events", "work.1", false, false, amqp.Publishing{Body: []byte("job")})
+	if err != nil {
+		t.Fatal(err)
+	}
+	next(t, msgs).Nack(false, false)
+	if n := b.QueueLen("dead"); n != 1 {
+		t.Errorf("dead holds %d messages, want the rejected job", n)
+	}
+}
+
+func TestDeclareTopologyReportsWhatFailed(t *testing.T) {
+	b := NewMemoryBroker()
+	err := DeclareTopology(b, routing.Topology{
+		Bindings: []routing.Binding{{Queue: "missing", Exchange: "events", Key: "#"}},
+	})
+	if err == nil || !strings.HasPrefix(err.Error(), "binding missing to events") {
+		t.Errorf("got %v, want a failed binding", err)
+	}
+}
@@ -0,0 +1,115 @@
+package pubsub
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"fmt"
+	"strings"
+
+	amqp "github.com/rabbitmq/amqp091-go"
+)
+
+const (
+	HeaderTraceparent = "traceparent"
+	HeaderCausationID = "x-causation-id"
+)
+
+// TraceContext is a W3C trace context. Every published message gets its own
+// span; messages published while handling another one share its trace and
+// record it as their cause.
+type TraceContext struct {
+	TraceID [16]byte
+	SpanID  [8]byte
+	Sampled bool
+}
+
+type traceKey struct{}
+
+type causationKey struct{}
+
+func ContextWithTrace(ctx context.Context, tc TraceContext) context.Context {
+	return context.WithValue(ctx, traceKey{}, tc)
+}
+
+func TraceFromContext(ctx context.Context) (TraceContext, bool) {
+	tc, ok := ctx.Value(traceKey{}).(TraceContext)
+	return tc, ok
+}
+
+// Traceparent formats tc as a traceparent header value.
+func (tc TraceContext) Traceparent() string {
+	flags := 0
+	if tc.Sampled {
+		flags = 1
+	}
+	return fmt.Sprintf("00-%x-%x-%02x", tc.TraceID, tc.SpanID, flags)
+}
+
+func ParseTraceparent(s string) (TraceContext, error) {
+	var tc TraceContext
+	parts := strings.Split(s, "-")
+	if len(parts) != 4 || len(parts[0]) != 2 || len(parts[1]) != 32 || len(parts[2]) != 16 || len(parts[3]) != 2 {
+		return tc, fmt.Errorf("malformed traceparent '%s'", s)
+	}
+	if parts[0] == "ff" {
+		return tc, fmt.Errorf("invalid traceparent version '%s'", parts[0])
+	}
+	if _, err := hex.Decode(tc.TraceID[:], []byte(parts[1])); err != nil {
+		return tc, fmt.Errorf("malformed trace id: %w", err)
+	}
+	if _, err := hex.Decode(tc.SpanID[:], []byte(parts[2])); err != nil {
+		return tc, fmt.Errorf("malformed span id: %w", err)
+	}
+	flags, err := hex.DecodeString(parts[3])
+	if err != nil {
+		return tc, fmt.Errorf("malformed trace flags: %w", err)
+	}
+	if tc.TraceID == [16]byte{} || tc.SpanID == [8]byte{} {
+		return tc, fmt.Errorf("traceparent '%s' has an all-zero id", s)
+	}
+	tc.Sampled = flags[0]&1 == 1
+	return tc, nil
+}
+
+// childSpan starts a span for a message published under ctx, continuing the
+// trace in ctx if there is one.
+func childSpan(ctx context.Context) TraceContext {
+	tc, ok := TraceFromContext(ctx)
+	if !ok {
+		rand.Read(tc.TraceID[:])
+		tc.Sampled = true
+	}
+	rand.Read(tc.SpanID[:])
+	return tc
+}
+
+// injectTrace adds the trace headers for a message published under ctx.
+func injectTrace(ctx context.Context, pub *amqp.Publishing) {
+	if pub.Headers == nil {
+		pub.Headers = amqp.Table{}
+	}
+	pub.Headers[HeaderTraceparent] = childSpan(ctx).Traceparent()
+	if cause, ok := ctx.Value(causationKey{}).(string); ok && cause != "" {
+		pub.Headers[HeaderCausationID] = cause
+	}
+}
+
+// extractTrace returns ctx carrying the delivery's trace context, so that
+// anything the handler publishes with it joins the same trace.
+func extractTrace(ctx context.Context, d amqp.Delivery) context.Context {
+	s, ok := d.Headers[HeaderTraceparent].(string)
+	if !ok {
+		return ctx
+	}
+	tc, err := ParseTraceparent(s)
+	if err != nil {
+		return ctx
+	}
+	cause := d.MessageId
+	if cause == "" {
+		cause = hex.EncodeToString(tc.SpanID[:])
+	}
+	ctx = ContextWithTrace(ctx, tc)
+	return context.WithValue(ctx, causationKey{}, cause)
+}
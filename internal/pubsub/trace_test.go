@@ -0,0 +1,163 @@
+package pubsub
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/bootdotdev/learn-pub-sub-starter/internal/routing"
+	amqp "github.com/rabbitmq/amqp091-go"
+)
+
+func TestParseTraceparent(t *testing.T) {
+	tests := []struct {
+		in      string
+		sampled bool
+		wantErr bool
+	}{
+		{in: "00-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-01", sampled: true},
+		{in: "00-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-00"},
+		// Later versions may add fields, but this one has the same layout.
+		{in: "01-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-03", sampled: true},
+		{in: "ff-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-01", wantErr: true},
+		{in: "00-00000000000000000000000000000000-00f067aa0ba902b7-01", wantErr: true},
+		{in: "00-4bf92f3577b34da6a3ce929d0e0e4736-0000000000000000-01", wantErr: true},
+		{in: "00-4bf92f3577b34da6a3ce929d0e0e473z-00f067aa0ba902b7-01", wantErr: true},
+		{in: "00-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-0g", wantErr: true},
+		{in: "00-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7", wantErr: true},
+		{in: "00-4bf92f3577b34da6-00f067aa0ba902b7-01", wantErr: true},
+		{in: "", wantErr: true},
+	}
+	for _, tt := range tests {
+		tc, err := ParseTraceparent(tt.in)
+		if tt.wantErr {
+			if err == nil {
+				t.Errorf("ParseTraceparent(%q) = %+v, want an error", tt.in, tc)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("ParseTraceparent(%q): %v", tt.in, err)
+			continue
+		}
+		if tc.Sampled != tt.sampled {
+			t.Errorf("ParseTraceparent(%q) sampled = %v, want %v", tt.in, tc.Sampled, tt.sampled)
+		}
+		if tt.in[:2] == "00" && tc.Traceparent() != tt.in {
+			t.Errorf("ParseTraceparent(%q) formats back as %q", tt.in, tc.Traceparent())
+		}
+	}
+}
+
+// A handler that publishes with its context continues the trace of the
+// message it is handling, in a span of its own.
+func TestSubscriptionPropagatesTrace(t *testing.T) {
+	b := newTestBroker(t)
+	sub, err := SubscribeContext(context.Background(), b, routing.ExchangePerilTopic, routing.GameLogSlug, routing.GameLogSlug+".*", DurableQueue,
+		func(ctx context.Context, gl routing.GameLog) SimpleAckType {
+			err := Publish(ctx, testChannel(t, b), routing.ExchangePerilTopic, "replies", gl)
+			if err != nil {
+				t.Error(err)
+			}
+			return Ack
+		},
+	)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer sub.Close()
+
+	ch := testChannel(t, b)
+	if _, err := ch.QueueDeclare("replies", false, true, true, false, nil); err != nil {
+		t.Fatal(err)
+	}
+	if err := ch.QueueBind("replies", "replies", routing.ExchangePerilTopic, false, nil); err != nil {
+		t.Fatal(err)
+	}
+	replies, err := ch.Consume("replies", "", true, false, false, false, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	parent := childSpan(context.Background())
+	var sent amqp.Publishing
+	capture := publisherFunc(func(ctx context.Context, exchange, key string, mandatory, immediate bool, msg amqp.Publishing) error {
+		sent = msg
+		return ch.PublishWithContext(ctx, exchange, key, mandatory, immediate, msg)
+	})
+	err = Publish(ContextWithTrace(context.Background(), parent), capture, routing.ExchangePerilTopic, "game_logs.alice", routing.GameLog{Username: "alice"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	sentTrace, err := ParseTraceparent(sent.Headers[HeaderTraceparent].(string))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if sentTrace.TraceID != parent.TraceID || sentTrace.SpanID == parent.SpanID {
+		t.Errorf("published in trace %x span %x, want a new span in trace %x", sentTrace.TraceID, sentTrace.SpanID, parent.TraceID)
+	}
+
+	var reply amqp.Delivery
+	select {
+	case reply = <-replies:
+	case <-time.After(time.Second):
+		t.Fatal("handler didn't publish")
+	}
+	replyTrace, err := ParseTraceparent(reply.Headers[HeaderTraceparent].(string))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if replyTrace.TraceID != parent.TraceID {
+		t.Errorf("reply is in trace %x, want %x", replyTrace.TraceID, parent.TraceID)
+	}
+	if replyTrace.SpanID == sentTrace.SpanID {
+		t.Error("reply reused the span of the message it answers")
+	}
+	if cause := reply.Headers[HeaderCausationID]; cause != sent.MessageId {
+		t.Errorf("reply caused by %v, want %s", cause, sent.MessageId)
+	}
+}
+
+// The context-taking publish helpers carry the trace of the message being
+// handled; the others start a new one.
+func TestPublishHelpersPropagateTrace(t *testing.T) {
+	parent := childSpan(context.Background())
+	handling := extractTrace(context.Background(), amqp.Delivery{
+		MessageId: "cause",
+		Headers:   amqp.Table{HeaderTraceparent: parent.Traceparent()},
+	})
+	tests := []struct {
+		name      string
+		publish   func(Publisher) error
+		wantCause bool
+	}{
+		{"PublishJSONContext", func(p Publisher) error { return PublishJSONContext(handling, p, "ex", "key", 1) }, true},
+		{"PublishGobContext", func(p Publisher) error { return PublishGobContext(handling, p, "ex", "key", 1) }, true},
+		{"PublishJSON", func(p Publisher) error { return PublishJSON(p, "ex", "key", 1) }, false},
+		{"PublishGob", func(p Publisher) error { return PublishGob(p, "ex", "key", 1) }, false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var got amqp.Publishing
+			err := tt.publish(publisherFunc(func(ctx context.Context, exchange, key string, mandatory, immediate bool, msg amqp.Publishing) error {
+				got = msg
+				return nil
+			}))
+			if err != nil {
+				t.Fatal(err)
+			}
+			tc, err := ParseTraceparent(got.Headers[HeaderTraceparent].(string))
+			if err != nil {
+				t.Fatal(err)
+			}
+			cause, _ := got.Headers[HeaderCausationID].(string)
+			if tt.wantCause {
+				if tc.TraceID != parent.TraceID || cause != "cause" {
+					t.Errorf("trace %x caused by %q, want trace %x caused by %q", tc.TraceID, cause, parent.TraceID, "cause")
+				}
+			} else if tc.TraceID == parent.TraceID || cause != "" {
+				t.Errorf("joined the handled message's trace without its context")
+			}
+		})
+	}
+}
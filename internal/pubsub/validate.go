@@ -0,0 +1,326 @@
+package pubsub
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log/slog"
+	"math"
+	"reflect"
+	"regexp"
+	"sort"
+	"unicode/utf8"
+
+	amqp "github.com/rabbitmq/amqp091-go"
+)
+
+const HeaderValidationError = "x-validation-error"
+
+// Validator is implemented by messages that can check their own contents.
+type Validator interface {
+	Validate() error
+}
+
+// WithValidation calls Validate on every decoded message whose type
+// implements Validator. Invalid messages are dead-lettered with the error in
+// HeaderValidationError and never reach the handler.
+func WithValidation() SubscribeOption {
+	return func(o *subscribeOptions) {
+		o.validate = true
+	}
+}
+
+// WithJSONSchema checks JSON bodies against s before decoding them. Bodies
+// that don't match, or that aren't JSON, are dead-lettered like messages
+// that fail WithValidation.
+func WithJSONSchema(s *JSONSchema) SubscribeOption {
+	return func(o *subscribeOptions) {
+		o.schema = s
+	}
+}
+
+func rejectInvalid(ctx context.Context, ch Publisher, d amqp.Delivery, o subscribeOptions, log *slog.Logger, err error) {
+	log.Warn("dead-lettering invalid delivery", "error", err)
+	if o.metrics != nil {
+		o.metrics.inc(metricValidationErrors, o.labels)
+	}
+	deadLetter(ctx, ch, d, amqp.Table{HeaderValidationError: err.Error()})
+}
+
+func validateValue(val any) error {
+	v, ok := val.(Validator)
+	if !ok {
+		return nil
+	}
+	return v.Validate()
+}
+
+// JSONSchema is a compiled JSON Schema. Only the keywords used to describe
+// message shapes are supported: type, properties, required,
+// additionalProperties, items, enum, minimum, maximum, minLength, maxLength,
+// pattern, minItems and maxItems. Compiling a schema that uses anything else
+// fails rather than silently accepting more than it should.
+type JSONSchema struct {
+	types       []string
+	properties  map[string]*JSONSchema
+	required    []string
+	closed      bool
+	items       *JSONSchema
+	enum        []any
+	minimum     *float64
+	maximum     *float64
+	minLength   *int
+	maxLength   *int
+	minItems    *int
+	maxItems    *int
+	pattern     *regexp.Regexp
+	patternText string
+}
+
+var schemaTypes = map[string]bool{
+	"object":  true,
+	"array":   true,
+	"string":  true,
+	"number":  true,
+	"integer": true,
+	"boolean": true,
+	"null":    true,
+}
+
+// schemaAnnotations are keywords that don't affect validation.
+var schemaAnnotations = map[string]bool{
+	"$schema":     true,
+	"$id":         true,
+	"$comment":    true,
+	"title":       true,
+	"description": true,
+	"default":     true,
+	"examples":    true,
+}
+
+// CompileJSONSchema parses a JSON Schema document.
+func CompileJSONSchema(data []byte) (*JSONSchema, error) {
+	return compileSchema(data, "$")
+}
+
+func compileSchema(data []byte, path string) (*JSONSchema, error) {
+	var kw map[string]json.RawMessage
+	err := json.Unmarshal(data, &kw)
+	if err != nil {
+		return nil, fmt.Errorf("schema %s: %w", path, err)
+	}
+	s := &JSONSchema{}
+	for k, raw := range kw {
+		err = s.compileKeyword(k, raw, path)
+		if err != nil {
+			return nil, fmt.Errorf("schema %s: %s: %w", path, k, err)
+		}
+	}
+	return s, nil
+}
+
+func (s *JSONSchema) compileKeyword(k string, raw json.RawMessage, path string) error {
+	switch k {
+	case "type":
+		var one string
+		if json.Unmarshal(raw, &one) == nil {
+			s.types = []string{one}
+		} else if err := json.Unmarshal(raw, &s.types); err != nil {
+			return err
+		}
+		for _, t := range s.types {
+			if !schemaTypes[t] {
+				return fmt.Errorf("unknown type '%s'", t)
+			}
+		}
+	case "properties":
+		var props map[string]json.RawMessage
+		if err := json.Unmarshal(raw, &props); err != nil {
+			return err
+		}
+		s.properties = make(map[string]*JSONSchema, len(props))
+		for name, p := range props {
+			ps, err := compileSchema(p, path+"."+name)
+			if err != nil {
+				return err
+			}
+			s.properties[name] = ps
+		}
+	case "required":
+		return json.Unmarshal(raw, &s.required)
+	case "additionalProperties":
+		var allowed bool
+		if err := json.Unmarshal(raw, &allowed); err != nil {
+			return errors.New("only true or false is supported")
+		}
+		s.closed = !allowed
+	case "items":
+		items, err := compileSchema(raw, path+"[]")
+		if err != nil {
+			return err
+		}
+		s.items = items
+	case "enum":
+		return json.Unmarshal(raw, &s.enum)
+	case "minimum":
+		return json.Unmarshal(raw, &s.minimum)
+	case "maximum":
+		return json.Unmarshal(raw, &s.maximum)
+	case "minLength":
+		return json.Unmarshal(raw, &s.minLength)
+	case "maxLength":
+		return json.Unmarshal(raw, &s.maxLength)
+	case "minItems":
+		return json.Unmarshal(raw, &s.minItems)
+	case "maxItems":
+		return json.Unmarshal(raw, &s.maxItems)
+	case "pattern":
+		if err := json.Unmarshal(raw, &s.patternText); err != nil {
+			return err
+		}
+		re, err := regexp.Compile(s.patternText)
+		if err != nil {
+			return err
+		}
+		s.pattern = re
+	default:
+		if !schemaAnnotations[k] {
+			return errors.New("unsupported keyword")
+		}
+	}
+	return nil
+}
+
+// ValidateJSON checks a JSON document against the schema and reports every
+// place it doesn't match.
+func (s *JSONSchema) ValidateJSON(data []byte) error {
+	var doc any
+	err := json.Unmarshal(data, &doc)
+	if err != nil {
+		return fmt.Errorf("invalid JSON: %w", err)
+	}
+	var errs []error
+	s.check(doc, "$", &errs)
+	return errors.Join(errs...)
+}
+
+func (s *JSONSchema) check(v any, path string, errs *[]error) {
+	fail := func(format string, args ...any) {
+		*errs = append(*errs, fmt.Errorf("%s: %s", path, fmt.Sprintf(format, args...)))
+	}
+	if len(s.types) > 0 && !s.hasType(v) {
+		fail("expected %s, got %s", joinTypes(s.types), jsonType(v))
+		return
+	}
+	if len(s.enum) > 0 && !s.inEnum(v) {
+		fail("value is not one of the allowed values")
+	}
+	switch v := v.(type) {
+	case map[string]any:
+		for _, name := range s.required {
+			if _, ok := v[name]; !ok {
+				fail("missing required property '%s'", name)
+			}
+		}
+		names := make([]string, 0, len(v))
+		for name := range v {
+			names = append(names, name)
+		}
+		sort.Strings(names)
+		for _, name := range names {
+			ps, ok := s.properties[name]
+			if !ok {
+				if s.closed {
+					fail("unexpected property '%s'", name)
+				}
+				continue
+			}
+			ps.check(v[name], path+"."+name, errs)
+		}
+	case []any:
+		if s.minItems != nil && len(v) < *s.minItems {
+			fail("expected at least %d items, got %d", *s.minItems, len(v))
+		}
+		if s.maxItems != nil && len(v) > *s.maxItems {
+			fail("expected at most %d items, got %d", *s.maxItems, len(v))
+		}
+		if s.items != nil {
+			for i, item := range v {
+				s.items.check(item, fmt.Sprintf("%s[%d]", path, i), errs)
+			}
+		}
+	case string:
+		n := utf8.RuneCountInString(v)
+		if s.minLength != nil && n < *s.minLength {
+			fail("expected at least %d characters, got %d", *s.minLength, n)
+		}
+		if s.maxLength != nil && n > *s.maxLength {
+			fail("expected at most %d characters, got %d", *s.maxLength, n)
+		}
+		if s.pattern != nil && !s.pattern.MatchString(v) {
+			fail("does not match pattern '%s'", s.patternText)
+		}
+	case float64:
+		if s.minimum != nil && v < *s.minimum {
+			fail("%v is less than the minimum %v", v, *s.minimum)
+		}
+		if s.maximum != nil && v > *s.maximum {
+			fail("%v is greater than the maximum %v", v, *s.maximum)
+		}
+	}
+}
+
+func (s *JSONSchema) hasType(v any) bool {
+	actual := jsonType(v)
+	for _, t := range s.types {
+		if t == actual || (t == "number" && actual == "integer") {
+			return true
+		}
+	}
+	return false
+}
+
+func (s *JSONSchema) inEnum(v any) bool {
+	for _, e := range s.enum {
+		if reflect.DeepEqual(e, v) {
+			return true
+		}
+	}
+	return false
+}
+
+func jsonType(v any) string {
+	switch v := v.(type) {
+	case map[string]any:
+		return "object"
+	case []any:
+		return "array"
+	case string:
+		return "string"
+	case float64:
+		if v == math.Trunc(v) {
+			return "integer"
+		}
+		return "number"
+	case bool:
+		return "boolean"
+	default:
+		return "null"
+	}
+}
+
+func joinTypes(types []string) string {
+	if len(types) == 1 {
+		return types[0]
+	}
+	return fmt.Sprintf("one of %v", types)
+}
+
+// checkSchema validates body against s, which only JSON bodies can match.
+func checkSchema(s *JSONSchema, contentType string, body []byte) error {
+	if contentType != JSON.ContentType() {
+		return fmt.Errorf("content type '%s' can't be checked against a JSON schema", contentType)
+	}
+	return s.ValidateJSON(body)
+}
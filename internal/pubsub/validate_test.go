@@ -0,0 +1,166 @@
+package pubsub
+
+import (
+	"context"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/bootdotdev/learn-pub-sub-starter/internal/routing"
+	amqp "github.com/rabbitmq/amqp091-go"
+)
+
+const testSchema = `{
+	"$schema": "https://json-schema.org/draft/2020-12/schema",
+	"title": "unit",
+	"type": "object",
+	"required": ["id", "rank"],
+	"additionalProperties": false,
+	"properties": {
+		"id": {"type": "integer", "minimum": 1},
+		"rank": {"enum": ["infantry", "cavalry", "artillery"]},
+		"name": {"type": "string", "minLength": 1, "maxLength": 8, "pattern": "^[a-z]+$"},
+		"tags": {"type": "array", "maxItems": 2, "items": {"type": "string"}},
+		"weight": {"type": ["number", "null"], "maximum": 10}
+	}
+}`
+
+func TestJSONSchema(t *testing.T) {
+	s, err := CompileJSONSchema([]byte(testSchema))
+	if err != nil {
+		t.Fatal(err)
+	}
+	tests := []struct {
+		name    string
+		doc     string
+		wantErr string
+	}{
+		{"valid", `{"id": 1, "rank": "cavalry", "name": "bob", "tags": ["a"], "weight": 2.5}`, ""},
+		{"null allowed", `{"id": 1, "rank": "cavalry", "weight": null}`, ""},
+		{"not JSON", `{`, "invalid JSON"},
+		{"wrong root type", `[]`, "$: expected object, got array"},
+		{"missing required", `{"id": 1}`, "missing required property 'rank'"},
+		{"extra property", `{"id": 1, "rank": "cavalry", "hp": 3}`, "unexpected property 'hp'"},
+		{"not an integer", `{"id": 1.5, "rank": "cavalry"}`, "$.id: expected integer, got number"},
+		{"below minimum", `{"id": 0, "rank": "cavalry"}`, "less than the minimum"},
+		{"above maximum", `{"id": 1, "rank": "cavalry", "weight": 11}`, "greater than the maximum"},
+		{"not in enum", `{"id": 1, "rank": "navy"}`, "$.rank: value is not one of the allowed values"},
+		{"too short", `{"id": 1, "rank": "cavalry", "name": ""}`, "at least 1 characters"},
+		{"too long", `{"id": 1, "rank": "cavalry", "name": "abcdefghi"}`, "at most 8 characters"},
+		{"pattern", `{"id": 1, "rank": "cavalry", "name": "Bob"}`, "does not match pattern"},
+		{"too many items", `{"id": 1, "rank": "cavalry", "tags": ["a", "b", "c"]}`, "at most 2 items"},
+		{"bad item", `{"id": 1, "rank": "cavalry", "tags": [1]}`, "$.tags[0]: expected string"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			err := s.ValidateJSON([]byte(tt.doc))
+			if tt.wantErr == "" {
+				if err != nil {
+					t.Fatal(err)
+				}
+				return
+			}
+			if err == nil || !strings.Contains(err.Error(), tt.wantErr) {
+				t.Fatalf("got %v, want an error containing %q", err, tt.wantErr)
+			}
+		})
+	}
+}
+
+func TestJSONSchemaReportsEveryProblem(t *testing.T) {
+	s, err := CompileJSONSchema([]byte(testSchema))
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = s.ValidateJSON([]byte(`{"id": 0, "rank": "navy", "hp": 1}`))
+	if err == nil {
+		t.Fatal("invalid document passed")
+	}
+	if n := len(strings.Split(err.Error(), "\n")); n != 3 {
+		t.Errorf("got %d problems, want 3:\n%v", n, err)
+	}
+}
+
+func TestCompileJSONSchemaRejectsUnsupported(t *testing.T) {
+	for _, doc := range []string{
+		`{"oneOf": [{"type": "string"}]}`,
+		`{"type": "object", "properties": {"a": {"$ref": "#/defs/a"}}}`,
+		`{"additionalProperties": {"type": "string"}}`,
+		`{"type": "float"}`,
+		`{"pattern": "("}`,
+	} {
+		if _, err := CompileJSONSchema([]byte(doc)); err == nil {
+			t.Errorf("compiled %s", doc)
+		}
+	}
+}
+
+func TestSchemaAndValidation(t *testing.T) {
+	schema, err := CompileJSONSchema([]byte(routing.PlayingStateSchema))
+	if err != nil {
+		t.Fatal(err)
+	}
+	logs := routing.GameLog{Username: "alice", Message: "hi", CurrentTime: time.Now()}
+	tests := []struct {
+		name        string
+		queue       string
+		key         string
+		contentType string
+		body        string
+		opts        []SubscribeOption
+		wantHandled bool
+	}{
+		{"matches schema", routing.PauseKey, routing.PauseKey, "application/json", `{"IsPaused": true}`, []SubscribeOption{WithJSONSchema(schema)}, true},
+		{"missing field", routing.PauseKey, routing.PauseKey, "application/json", `{}`, []SubscribeOption{WithJSONSchema(schema)}, false},
+		{"not JSON", routing.PauseKey, routing.PauseKey, "application/gob", `x`, []SubscribeOption{WithJSONSchema(schema)}, false},
+		{"valid log", routing.GameLogSlug, "game_logs.alice", "application/json", `{"Username": "alice", "Message": "hi", "CurrentTime": "` + logs.CurrentTime.Format(time.RFC3339) + `"}`, []SubscribeOption{WithValidation()}, true},
+		{"invalid log", routing.GameLogSlug, "game_logs.alice", "application/json", `{"Username": "alice"}`, []SubscribeOption{WithValidation()}, false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			b := newTestBroker(t)
+			handled := make(chan struct{}, 1)
+			var sub *Subscription
+			var err error
+			exchange := routing.ExchangePerilDirect
+			if tt.queue == routing.GameLogSlug {
+				exchange = routing.ExchangePerilTopic
+				sub, err = Subscribe(context.Background(), b, exchange, tt.queue, "game_logs.*", DurableQueue,
+					func(routing.GameLog) SimpleAckType { handled <- struct{}{}; return Ack }, tt.opts...)
+			} else {
+				sub, err = Subscribe(context.Background(), b, exchange, tt.queue, tt.key, DurableQueue,
+					func(routing.PlayingState) SimpleAckType { handled <- struct{}{}; return Ack }, tt.opts...)
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer sub.Close()
+			err = testChannel(t, b).PublishWithContext(context.Background(), exchange, tt.key, false, false, amqp.Publishing{
+				ContentType: tt.contentType,
+				Body:        []byte(tt.body),
+			})
+			if err != nil {
+				t.Fatal(err)
+			}
+			if tt.wantHandled {
+				select {
+				case <-handled:
+				case <-time.After(time.Second):
+					t.Fatal("valid message was not handled")
+				}
+				return
+			}
+			waitFor(t, "message to be dead-lettered", func() bool { return b.QueueLen(routing.DeadLetterQueue) == 1 })
+			d, ok, err := testChannel(t, b).(getChannel).Get(routing.DeadLetterQueue, true)
+			if err != nil || !ok {
+				t.Fatalf("getting dead letter: %v", err)
+			}
+			if _, ok := d.Headers[HeaderValidationError].(string); !ok {
+				t.Errorf("dead letter has headers %v, want %s", d.Headers, HeaderValidationError)
+			}
+			if len(handled) > 0 {
+				t.Error("invalid message reached the handler")
+			}
+		})
+	}
+}
@@ -1,13 +1,60 @@
 package routing
 
-import "time"
+import (
+	"errors"
+	"time"
+)
 
 type PlayingState struct {
 	IsPaused bool
 }
 
+// Sender is always the server; only it may pause or resume the game.
+func (PlayingState) Sender() string {
+	return ServerKeyID
+}
+
+// Validate accepts every PlayingState. A body missing IsPaused still
+// decodes, as "not paused", so JSON subscribers should also check
+// PlayingStateSchema.
+func (PlayingState) Validate() error {
+	return nil
+}
+
+// PlayingStateSchema is the JSON Schema of a PlayingState.
+const PlayingStateSchema = `{
+	"type": "object",
+	"required": ["IsPaused"],
+	"properties": {
+		"IsPaused": {"type": "boolean"}
+	},
+	"additionalProperties": false
+}`
+
+// PauseStateRequest asks the server for the current PlayingState.
+type PauseStateRequest struct {
+	Username string
+}
+
 type GameLog struct {
 	CurrentTime time.Time
 	Message     string
 	Username    string
 }
+
+func (gl GameLog) Sender() string {
+	return gl.Username
+}
+
+func (gl GameLog) Validate() error {
+	if gl.Username == "" {
+		return errors.New("game log has no username")
+	}
+	if gl.Message == "" {
+		return errors.New("game log has no message")
+	}
+	if gl.CurrentTime.IsZero() {
+		return errors.New("game log has no time")
+	}
+	return nil
+}
@@ -7,9 +7,18 @@ const (
 
 	PauseKey = "pause"
 
+	PauseStateKey = "pause_state"
+
 	GameLogSlug = "game_logs"
 
 	DeadLetterQueue = "peril_dlq"
+
+	// ServerKeyID is the signing key the server publishes with.
+	ServerKeyID = "server"
+
+	// KeysEnv names the environment variable pointing at the key file used
+	// to sign and verify messages. Signing is off when it is unset.
+	KeysEnv = "PERIL_KEYS"
 )
 
 const (
@@ -0,0 +1,201 @@
+package routing
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"math"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"gopkg.in/yaml.v3"
+)
+
+// Topology describes the exchanges, queues and bindings a broker needs
+// before any client connects.
+type Topology struct {
+	Exchanges []Exchange `yaml:"exchanges,omitempty" json:"exchanges,omitempty"`
+	Queues    []Queue    `yaml:"queues,omitempty" json:"queues,omitempty"`
+	Bindings  []Binding  `yaml:"bindings,omitempty" json:"bindings,omitempty"`
+}
+
+type Exchange struct {
+	Name       string         `yaml:"name" json:"name"`
+	Kind       string         `yaml:"kind" json:"kind"`
+	Durable    bool           `yaml:"durable,omitempty" json:"durable,omitempty"`
+	AutoDelete bool           `yaml:"auto_delete,omitempty" json:"auto_delete,omitempty"`
+	Internal   bool           `yaml:"internal,omitempty" json:"internal,omitempty"`
+	Args       map[string]any `yaml:"args,omitempty" json:"args,omitempty"`
+}
+
+type Queue struct {
+	Name       string         `yaml:"name" json:"name"`
+	Durable    bool           `yaml:"durable,omitempty" json:"durable,omitempty"`
+	AutoDelete bool           `yaml:"auto_delete,omitempty" json:"auto_delete,omitempty"`
+	Args       map[string]any `yaml:"args,omitempty" json:"args,omitempty"`
+	// DeadLetterExchange and DeadLetterRoutingKey are shorthands for the
+	// x-dead-letter-* arguments.
+	DeadLetterExchange   string `yaml:"dead_letter_exchange,omitempty" json:"dead_letter_exchange,omitempty"`
+	DeadLetterRoutingKey string `yaml:"dead_letter_routing_key,omitempty" json:"dead_letter_routing_key,omitempty"`
+}
+
+type Binding struct {
+	Queue    string         `yaml:"queue" json:"queue"`
+	Exchange string         `yaml:"exchange" json:"exchange"`
+	Key      string         `yaml:"key" json:"key"`
+	Args     map[string]any `yaml:"args,omitempty" json:"args,omitempty"`
+}
+
+// Arguments returns the queue's declare arguments, including its
+// dead-letter settings.
+func (q Queue) Arguments() map[string]any {
+	if len(q.Args) == 0 && q.DeadLetterExchange == "" && q.DeadLetterRoutingKey == "" {
+		return nil
+	}
+	args := map[string]any{}
+	for k, v := range q.Args {
+		args[k] = v
+	}
+	if q.DeadLetterExchange != "" {
+		args["x-dead-letter-exchange"] = q.DeadLetterExchange
+	}
+	if q.DeadLetterRoutingKey != "" {
+		args["x-dead-letter-routing-key"] = q.DeadLetterRoutingKey
+	}
+	return args
+}
+
+// PerilTopology is the part of the game's topology that doesn't depend on
+// who is playing: the exchanges and the dead-letter queue. Per-player
+// queues are declared when their subscriptions start.
+func PerilTopology() Topology {
+	return Topology{
+		Exchanges: []Exchange{
+			{Name: ExchangePerilDirect, Kind: "direct", Durable: true},
+			{Name: ExchangePerilTopic, Kind: "topic", Durable: true},
+			{Name: ExchangePerilDeadLetter, Kind: "fanout", Durable: true},
+		},
+		Queues: []Queue{
+			{Name: DeadLetterQueue, Durable: true},
+		},
+		Bindings: []Binding{
+			{Queue: DeadLetterQueue, Exchange: ExchangePerilDeadLetter, Key: ""},
+		},
+	}
+}
+
+// TopologyFormat guesses a topology file's format, "yaml" or "json", from
+// its extension.
+func TopologyFormat(path string) (string, error) {
+	switch strings.ToLower(filepath.Ext(path)) {
+	case ".yaml", ".yml":
+		return "yaml", nil
+	case ".json":
+		return "json", nil
+	default:
+		return "", fmt.Errorf("unknown topology format for '%s', want .yaml, .yml or .json", path)
+	}
+}
+
+func LoadTopology(path string) (Topology, error) {
+	format, err := TopologyFormat(path)
+	if err != nil {
+		return Topology{}, err
+	}
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return Topology{}, err
+	}
+	t, err := ParseTopology(data, format)
+	if err != nil {
+		return Topology{}, fmt.Errorf("%s: %w", path, err)
+	}
+	return t, nil
+}
+
+func ParseTopology(data []byte, format string) (Topology, error) {
+	var t Topology
+	switch format {
+	case "yaml":
+		dec := yaml.NewDecoder(bytes.NewReader(data))
+		dec.KnownFields(true)
+		if err := dec.Decode(&t); err != nil && err != io.EOF {
+			return Topology{}, err
+		}
+	case "json":
+		dec := json.NewDecoder(bytes.NewReader(data))
+		dec.DisallowUnknownFields()
+		if err := dec.Decode(&t); err != nil {
+			return Topology{}, err
+		}
+		// JSON numbers decode as float64, but RabbitMQ wants integers for
+		// arguments like x-message-ttl.
+		for i := range t.Exchanges {
+			integerArgs(t.Exchanges[i].Args)
+		}
+		for i := range t.Queues {
+			integerArgs(t.Queues[i].Args)
+		}
+		for i := range t.Bindings {
+			integerArgs(t.Bindings[i].Args)
+		}
+	default:
+		return Topology{}, fmt.Errorf("unknown topology format '%s'", format)
+	}
+	return t, t.Validate()
+}
+
+func integerArgs(args map[string]any) {
+	for k, v := range args {
+		if f, ok := v.(float64); ok && f == math.Trunc(f) {
+			args[k] = int64(f)
+		}
+	}
+}
+
+// Validate checks that every entry is named and every exchange has a kind
+// RabbitMQ knows.
+func (t Topology) Validate() error {
+	for i, ex := range t.Exchanges {
+		if ex.Name == "" {
+			return fmt.Errorf("exchange %d has no name", i)
+		}
+		switch ex.Kind {
+		case "direct", "fanout", "topic", "headers":
+		default:
+			return fmt.Errorf("exchange %s has unknown kind '%s'", ex.Name, ex.Kind)
+		}
+	}
+	for i, q := range t.Queues {
+		if q.Name == "" {
+			return fmt.Errorf("queue %d has no name", i)
+		}
+	}
+	for i, b := range t.Bindings {
+		if b.Queue == "" || b.Exchange == "" {
+			return fmt.Errorf("binding %d needs a queue and an exchange", i)
+		}
+	}
+	return nil
+}
+
+// Encode writes t as "yaml" or "json".
+func (t Topology) Encode(w io.Writer, format string) error {
+	switch format {
+	case "yaml":
+		enc := yaml.NewEncoder(w)
+		enc.SetIndent(2)
+		if err := enc.Encode(t); err != nil {
+			return err
+		}
+		return enc.Close()
+	case "json":
+		enc := json.NewEncoder(w)
+		enc.SetIndent("", "  ")
+		return enc.Encode(t)
+	default:
+		return fmt.Errorf("unknown topology format '%s'", format)
+	}
+}